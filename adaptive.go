@@ -0,0 +1,170 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teambition/gear"
+)
+
+// AdaptivePolicy bounds the adaptive concurrency limit of a route. The limit grows by one when
+// the requests use it without trouble, and shrinks by Backoff when a request is slow or fails.
+type AdaptivePolicy struct {
+	// Min is the lower bound of the limit, default is 1.
+	Min int
+	// Max is the upper bound of the limit, it is required.
+	Max int
+	// Initial is the limit to start with, default is Max.
+	Initial int
+	// Latency is the target latency, slower requests decrease the limit. 0 ignores latency.
+	// It is measured until the response header is written, not until the body is sent.
+	Latency time.Duration
+	// Backoff is the factor the limit is multiplied by when it decreases, default is 0.9.
+	Backoff float64
+}
+
+// AdaptiveOptions for AdaptiveLimiter.
+type AdaptiveOptions struct {
+	// Policies by policy keys of Options.Policies, all requests matching a key share its limit.
+	Policies map[string]*AdaptivePolicy
+	// DefaultPolicy is the policy of requests matching no policy, they are not limited if it is nil.
+	DefaultPolicy *AdaptivePolicy
+	// Headers sets the X-Concurrency-Limit header with the current limit, default is HeadersDefault.
+	Headers HeaderMode
+	// OnLimit is called with the policy key and the new limit when a limit changes, use it for metrics.
+	// The key of DefaultPolicy is "".
+	OnLimit func(key string, limit int)
+}
+
+// adaptiveState is the limit and the in-flight requests of a policy key.
+type adaptiveState struct {
+	mu       sync.Mutex
+	policy   *AdaptivePolicy
+	limit    float64
+	inflight int
+}
+
+// AdaptiveLimiter is a middleware limiting in-flight requests of a service instance, the limit of
+// every route adapts to the latency and errors of its requests within the bounds of its policy.
+type AdaptiveLimiter struct {
+	options *AdaptiveOptions
+	states  map[string]*adaptiveState
+	matcher *matcher
+}
+
+// NewAdaptiveLimiter returns an AdaptiveLimiter, or a *ValidationError for wrong options.
+func NewAdaptiveLimiter(opts *AdaptiveOptions) (*AdaptiveLimiter, error) {
+	var errs []error
+	l := &AdaptiveLimiter{options: opts, states: make(map[string]*adaptiveState)}
+	add := func(name, key string, p *AdaptivePolicy) {
+		c := *p
+		if c.Min == 0 {
+			c.Min = 1
+		}
+		if c.Initial == 0 {
+			c.Initial = c.Max
+		}
+		if c.Backoff == 0 {
+			c.Backoff = 0.9
+		}
+		switch {
+		case c.Min < 0 || c.Max < c.Min:
+			errs = append(errs, fmt.Errorf("%s, should have 0 < Min <= Max, got %d and %d", name, c.Min, c.Max))
+		case c.Initial < c.Min || c.Initial > c.Max:
+			errs = append(errs, fmt.Errorf("%s, Initial should be in [Min, Max], got %d", name, c.Initial))
+		case c.Latency < 0:
+			errs = append(errs, fmt.Errorf("%s, Latency should not be negative, got %v", name, c.Latency))
+		case c.Backoff <= 0 || c.Backoff >= 1:
+			errs = append(errs, fmt.Errorf("%s, Backoff should be in (0, 1), got %v", name, c.Backoff))
+		default:
+			l.states[key] = &adaptiveState{policy: &c, limit: float64(c.Initial)}
+		}
+	}
+	keys := sortedKeys(opts.Policies)
+	for _, key := range keys {
+		if _, err := compileRoute(key); err != nil {
+			errs = append(errs, err)
+		} else if p := opts.Policies[key]; p == nil {
+			errs = append(errs, fmt.Errorf("policy %q is nil", key))
+		} else {
+			add(fmt.Sprintf("policy %q", key), key, p)
+		}
+	}
+	if opts.DefaultPolicy != nil {
+		add("default policy", "", opts.DefaultPolicy)
+	}
+	if opts.Headers != HeadersDefault && opts.Headers != HeadersNone {
+		errs = append(errs, fmt.Errorf("unknown header mode %d", opts.Headers))
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	l.matcher, _ = newMatcher(keys)
+	return l, nil
+}
+
+// Limit returns the current limit of a policy key, "" for the default policy, or 0 if the key has no policy.
+func (l *AdaptiveLimiter) Limit(key string) int {
+	s := l.states[key]
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.limit)
+}
+
+//Serve ...
+func (l *AdaptiveLimiter) Serve(ctx *gear.Context) error {
+	key := ""
+	if r := l.matcher.match(ctx.Method, ctx.Path); r != nil {
+		key = r.key
+	}
+	s := l.states[key]
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	limit := int(s.limit)
+	allowed := s.inflight < limit
+	if allowed {
+		s.inflight++
+	}
+	s.mu.Unlock()
+	if l.options.Headers == HeadersDefault {
+		ctx.Set("X-Concurrency-Limit", strconv.Itoa(limit))
+	}
+	if !allowed {
+		return gear.ErrTooManyRequests.WithMsg("Too many concurrent requests.")
+	}
+	start := time.Now()
+	// end hooks run in a goroutine once the header is written, so a request stays in flight
+	// a little after its response.
+	ctx.OnEnd(func() {
+		l.done(key, s, time.Since(start), ctx.Res.Status())
+	})
+	return nil
+}
+
+// done adjusts the limit with a finished request: multiplicative decrease if it was slow or failed,
+// additive increase, by one per limit requests, if the limit was half used at least.
+func (l *AdaptiveLimiter) done(key string, s *adaptiveState, latency time.Duration, status int) {
+	p := s.policy
+	s.mu.Lock()
+	old := int(s.limit)
+	if status >= 500 || (p.Latency > 0 && latency > p.Latency) {
+		s.limit = math.Max(float64(p.Min), s.limit*p.Backoff)
+	} else if s.inflight*2 >= old {
+		s.limit = math.Min(float64(p.Max), s.limit+1/s.limit)
+	}
+	s.inflight--
+	limit := int(s.limit)
+	s.mu.Unlock()
+	if limit != old && l.options.OnLimit != nil {
+		l.options.OnLimit(key, limit)
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	t.Run("limits should adapt", func(t *testing.T) {
+		assert := assert.New(t)
+		var changes []int
+		l, err := NewAdaptiveLimiter(&AdaptiveOptions{
+			Policies: map[string]*AdaptivePolicy{
+				"/a": &AdaptivePolicy{Min: 2, Max: 4, Initial: 2, Latency: time.Second, Backoff: 0.5},
+			},
+			OnLimit: func(key string, limit int) {
+				assert.Equal("/a", key)
+				changes = append(changes, limit)
+			},
+		})
+		assert.Nil(err)
+		s := l.states["/a"]
+		run := func(inflight int, latency time.Duration, status int) {
+			s.inflight = inflight
+			l.done("/a", s, latency, status)
+		}
+		// the limit is not used enough to grow
+		run(0, 0, 200)
+		assert.Equal(2, l.Limit("/a"))
+		for i := 0; i < 3; i++ {
+			run(1, 0, 200)
+		}
+		assert.Equal(3, l.Limit("/a"))
+		for i := 0; i < 10; i++ {
+			run(3, 0, 200)
+		}
+		assert.Equal(4, l.Limit("/a"))
+		run(3, 2*time.Second, 200)
+		assert.Equal(2, l.Limit("/a"))
+		run(2, 0, 500)
+		assert.Equal(2, l.Limit("/a"))
+		assert.Equal([]int{3, 4, 2}, changes)
+		assert.Equal(0, l.Limit("/b"))
+	})
+
+	t.Run("AdaptiveLimiter should be", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := NewAdaptiveLimiter(&AdaptiveOptions{
+			DefaultPolicy: &AdaptivePolicy{Max: 1},
+		})
+		assert.Nil(err)
+		release := make(chan struct{})
+		app := gear.New()
+		app.UseHandler(l)
+		app.Use(func(ctx *gear.Context) error {
+			if ctx.Path == "/wait" {
+				<-release
+			}
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		done := make(chan int)
+		go func() {
+			res, err := http.Get("http://" + srv.Addr().String() + "/wait")
+			assert.Nil(err)
+			done <- res.StatusCode
+		}()
+		inflight := func() int {
+			s := l.states[""]
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.inflight
+		}
+		for i := 0; i < 100 && inflight() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		res, err := http.Get("http://" + srv.Addr().String() + "/b")
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Concurrency-Limit"))
+		close(release)
+		assert.Equal(200, <-done)
+		// the request is done by an end hook after the response
+		for i := 0; i < 100 && inflight() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		res, err = http.Get("http://" + srv.Addr().String() + "/b")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+	})
+
+	t.Run("wrong options should error", func(t *testing.T) {
+		_, err := NewAdaptiveLimiter(&AdaptiveOptions{
+			Policies: map[string]*AdaptivePolicy{
+				"/a": &AdaptivePolicy{},
+				"/b": &AdaptivePolicy{Max: 10, Initial: 20},
+				"/c": &AdaptivePolicy{Max: 10, Backoff: 1.5},
+				"/d": nil,
+			},
+			DefaultPolicy: &AdaptivePolicy{Max: 1, Latency: -1},
+			Headers:       3,
+		})
+		assert.Equal(t, `ratelimiter: invalid options: policy "/a", should have 0 < Min <= Max, got 1 and 0; `+
+			`policy "/b", Initial should be in [Min, Max], got 20; policy "/c", Backoff should be in (0, 1), got 1.5; `+
+			`policy "/d" is nil; default policy, Latency should not be negative, got -1ns; unknown header mode 3`, err.Error())
+	})
+}
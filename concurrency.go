@@ -0,0 +1,231 @@
+package ratelimiter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/teambition/gear"
+	baselimiter "github.com/teambition/ratelimiter-go"
+)
+
+// Lease caps the in-flight requests holding Key at Max.
+type Lease struct {
+	Key string
+	Max int
+}
+
+// LeaseStore keeps leases of in-flight requests, it must be safe for concurrent use.
+// NewMemoryLeaseStore returns a LeaseStore in memory, and the clients of
+// github.com/teambition/gear-ratelimiter/redis implement it with redis sorted sets.
+type LeaseStore interface {
+	// Acquire adds a lease named id to every key if none of them is full, and returns -1.
+	// Otherwise it adds nothing and returns the index of the first full lease.
+	// Leases expire after ttl, so that a crashed instance doesn't hold them forever.
+	Acquire(id string, leases []Lease, ttl time.Duration) (int, error)
+	// Release removes the leases named id.
+	Release(id string, leases []Lease) error
+}
+
+type memoryLeaseStore struct {
+	mu   sync.Mutex
+	keys map[string]map[string]time.Time // expire time of leases by key and id
+}
+
+// NewMemoryLeaseStore returns a LeaseStore keeping leases in memory.
+func NewMemoryLeaseStore() LeaseStore {
+	return &memoryLeaseStore{keys: make(map[string]map[string]time.Time)}
+}
+
+func (s *memoryLeaseStore) Acquire(id string, leases []Lease, ttl time.Duration) (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, lease := range leases {
+		ids := s.keys[lease.Key]
+		for k, expire := range ids {
+			if !now.Before(expire) {
+				delete(ids, k)
+			}
+		}
+		if len(ids) >= lease.Max {
+			return i, nil
+		}
+	}
+	for _, lease := range leases {
+		ids := s.keys[lease.Key]
+		if ids == nil {
+			ids = make(map[string]time.Time)
+			s.keys[lease.Key] = ids
+		}
+		ids[id] = now.Add(ttl)
+	}
+	return -1, nil
+}
+
+func (s *memoryLeaseStore) Release(id string, leases []Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lease := range leases {
+		if ids := s.keys[lease.Key]; ids != nil {
+			delete(ids, id)
+			if len(ids) == 0 {
+				delete(s.keys, lease.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// ConcurrencyPolicy caps in-flight requests on a route, 0 is unlimited.
+type ConcurrencyPolicy struct {
+	// PerClient caps the in-flight requests of a client.
+	PerClient int
+	// Total caps the in-flight requests of all clients.
+	Total int
+}
+
+// ConcurrencyOptions for ConcurrencyLimiter.
+type ConcurrencyOptions struct {
+	// Client keeps leases in redis, it should implement LeaseStore. A memory LeaseStore is used if omitted.
+	Client baselimiter.RedisClient
+	// Prefix of redis keys, default is "LIMIT:".
+	Prefix string
+	// GetID returns the id of a client, default is ByIP(). Requests with an empty id are not limited.
+	GetID func(ctx *gear.Context) string
+	// Policies by policy keys of Options.Policies, such as "GET /export/:id". All requests matching
+	// a key share its caps.
+	Policies map[string]*ConcurrencyPolicy
+	// DefaultPolicy is the policy of requests matching no policy, they are not limited if it is nil.
+	DefaultPolicy *ConcurrencyPolicy
+	// LeaseTTL is the time a lease is held at most, default is 1 minute. It should be longer than
+	// the slowest request, a request holding the lease longer is no longer counted.
+	LeaseTTL time.Duration
+	// FailMode decides how requests are handled when the store fails, FailOpen or FailClosed.
+	FailMode FailMode
+	// OnError is called with the store error before FailMode applies. A non-nil returned error is
+	// returned by the middleware. If omitted, errors are written by the standard logger.
+	OnError func(ctx *gear.Context, err error) error
+}
+
+// ConcurrencyLimiter is a middleware capping simultaneous in-flight requests per client and per route.
+// The leases of a request are released when the request ends, even if a handler panics.
+type ConcurrencyLimiter struct {
+	options  *ConcurrencyOptions
+	getID    func(ctx *gear.Context) string
+	prefix   string
+	store    LeaseStore
+	policies map[string]*ConcurrencyPolicy
+	matcher  *matcher
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter, or a *ValidationError for wrong options.
+func NewConcurrencyLimiter(opts *ConcurrencyOptions) (*ConcurrencyLimiter, error) {
+	var errs []error
+	report := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	l := &ConcurrencyLimiter{options: opts, getID: opts.GetID, prefix: opts.Prefix, policies: opts.Policies}
+	if opts.Client == nil {
+		l.store = NewMemoryLeaseStore()
+	} else if store, ok := opts.Client.(LeaseStore); ok {
+		l.store = store
+	} else {
+		report("Client should implement LeaseStore")
+	}
+	if opts.LeaseTTL < 0 {
+		report("LeaseTTL should not be negative, got %v", opts.LeaseTTL)
+	}
+	if opts.FailMode != FailOpen && opts.FailMode != FailClosed {
+		report("FailMode should be FailOpen or FailClosed, got %d", opts.FailMode)
+	}
+	checkPolicy := func(name string, p *ConcurrencyPolicy) {
+		if p.PerClient < 0 || p.Total < 0 {
+			report("%s, caps should not be negative, got %d and %d", name, p.PerClient, p.Total)
+		}
+	}
+	keys := sortedKeys(opts.Policies)
+	for _, key := range keys {
+		if _, err := compileRoute(key); err != nil {
+			errs = append(errs, err)
+		} else if p := opts.Policies[key]; p == nil {
+			report("policy %q is nil", key)
+		} else {
+			checkPolicy(fmt.Sprintf("policy %q", key), p)
+		}
+	}
+	if opts.DefaultPolicy != nil {
+		checkPolicy("default policy", opts.DefaultPolicy)
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+
+	l.matcher, _ = newMatcher(keys)
+	if l.prefix == "" {
+		l.prefix = "LIMIT:"
+	}
+	if l.getID == nil {
+		l.getID = ByIP()
+	}
+	return l, nil
+}
+
+//Serve ...
+func (l *ConcurrencyLimiter) Serve(ctx *gear.Context) error {
+	id := l.getID(ctx)
+	if id == "" {
+		return nil
+	}
+	key, p := "", l.options.DefaultPolicy
+	if r := l.matcher.match(ctx.Method, ctx.Path); r != nil {
+		key, p = r.key, l.policies[r.key]
+	}
+	if p == nil {
+		return nil
+	}
+	var leases []Lease
+	if p.PerClient > 0 {
+		leases = append(leases, Lease{Key: l.prefix + "inflight:" + id + "#" + key, Max: p.PerClient})
+	}
+	if p.Total > 0 {
+		leases = append(leases, Lease{Key: l.prefix + "inflight:#" + key, Max: p.Total})
+	}
+	if len(leases) == 0 {
+		return nil
+	}
+
+	lease := newLeaseID()
+	ttl := l.options.LeaseTTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	full, err := l.store.Acquire(lease, leases, ttl)
+	if err != nil {
+		if err = reportError(ctx, l.options.OnError, err); err != nil {
+			return err
+		}
+		if l.options.FailMode == FailClosed {
+			return gear.ErrServiceUnavailable.WithMsg("Rate limiter is unavailable.")
+		}
+		return nil
+	}
+	if full >= 0 {
+		return gear.ErrTooManyRequests.WithMsg("Too many concurrent requests.")
+	}
+	onDone(ctx, func() {
+		if err := l.store.Release(lease, leases); err != nil {
+			reportError(ctx, l.options.OnError, err)
+		}
+	})
+	return nil
+}
+
+// newLeaseID returns a random id of a request.
+func newLeaseID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,209 @@
+package ratelimiter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/teambition/gear"
+)
+
+// ByIP returns a GetID function using the client IP, it is the default GetID.
+// The forwarded headers X-Forwarded-For, Forwarded and X-Real-IP can be set by anyone,
+// so they are only read when the peer address is one of trustedProxies (IPs or CIDRs,
+// such as "10.0.0.0/8"). X-Forwarded-For and Forwarded are walked from the right,
+// the first address not in trustedProxies is the client IP.
+// It panics for a wrong trusted proxy.
+func ByIP(trustedProxies ...string) func(ctx *gear.Context) string {
+	return ByIPNet(0, trustedProxies...)
+}
+
+// ByIPNet returns a GetID function like ByIP, but IPv6 client addresses are aggregated by
+// their first v6Prefix bits, such as 64, so that a client can't evade limits by rotating the
+// addresses of its network. The id is the network, such as "2001:db8::/64".
+// If v6Prefix is 0 or 128, IPv6 addresses are not aggregated.
+// It panics for a wrong trusted proxy or prefix.
+func ByIPNet(v6Prefix int, trustedProxies ...string) func(ctx *gear.Context) string {
+	trusted, err := parseCIDRs(trustedProxies)
+	if err == nil && (v6Prefix < 0 || v6Prefix > 128) {
+		err = fmt.Errorf("IPv6 prefix should be between 0 and 128, got %d", v6Prefix)
+	}
+	if err != nil {
+		panic(fmt.Errorf("ratelimiter: %v", err))
+	}
+	return func(ctx *gear.Context) string {
+		return ipID(clientIP(ctx.Req, trusted), v6Prefix)
+	}
+}
+
+// ByHeader returns a GetID function using the value of a request header, such as "X-API-Key".
+func ByHeader(name string) func(ctx *gear.Context) string {
+	return func(ctx *gear.Context) string {
+		return ctx.Get(name)
+	}
+}
+
+// ByCookie returns a GetID function using the value of a cookie.
+func ByCookie(name string) func(ctx *gear.Context) string {
+	return func(ctx *gear.Context) string {
+		if cookie, err := ctx.Req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+}
+
+// ByQuery returns a GetID function using the value of a query parameter.
+func ByQuery(name string) func(ctx *gear.Context) string {
+	return func(ctx *gear.Context) string {
+		return ctx.Query(name)
+	}
+}
+
+// ByJWTClaim returns a GetID function using a claim of the bearer token in the Authorization
+// header, such as "sub". String and number claims are supported.
+// The token is NOT verified, so the limiter should be mounted after the authentication
+// middleware that rejects invalid tokens.
+func ByJWTClaim(claim string) func(ctx *gear.Context) string {
+	return func(ctx *gear.Context) string {
+		return jwtClaim(ctx.Get("Authorization"), claim)
+	}
+}
+
+// FirstOf returns a GetID function using the first non-empty id of getters,
+// such as FirstOf(ByJWTClaim("sub"), ByIP()) limits users by their id, and others by IP.
+func FirstOf(getters ...func(ctx *gear.Context) string) func(ctx *gear.Context) string {
+	return func(ctx *gear.Context) string {
+		for _, get := range getters {
+			if id := get(ctx); id != "" {
+				return id
+			}
+		}
+		return ""
+	}
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipID returns the id of a client IP, IPv6 addresses are aggregated by v6Prefix.
+func ipID(ip net.IP, v6Prefix int) string {
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil && v6Prefix > 0 && v6Prefix < 8*net.IPv6len {
+		mask := net.CIDRMask(v6Prefix, 8*net.IPv6len)
+		return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+	return ip.String()
+}
+
+// clientIP returns the client IP of req, it trusts forwarded headers only from trusted peers.
+func clientIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	ip := parseIP(req.RemoteAddr)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+	if v := req.Header["X-Forwarded-For"]; len(v) > 0 {
+		return walkForwarded(ip, strings.Split(strings.Join(v, ","), ","), trusted)
+	}
+	if v := req.Header["Forwarded"]; len(v) > 0 {
+		var chain []string
+		for _, elem := range strings.Split(strings.Join(v, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					chain = append(chain, kv[1])
+				}
+			}
+		}
+		return walkForwarded(ip, chain, trusted)
+	}
+	if real := parseIP(req.Header.Get("X-Real-IP")); real != nil {
+		return real
+	}
+	return ip
+}
+
+// walkForwarded walks the chain of addresses from the right, and returns the first
+// address not in trusted. It stops at an invalid address and returns the last valid one.
+func walkForwarded(ip net.IP, chain []string, trusted []*net.IPNet) net.IP {
+	for i := len(chain) - 1; i >= 0; i-- {
+		next := parseIP(chain[i])
+		if next == nil {
+			break
+		}
+		if ip = next; !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseIP parses an address such as "1.2.3.4", "1.2.3.4:80", "[::1]:80" or `"[::1]"`.
+func parseIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+func jwtClaim(auth, claim string) string {
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
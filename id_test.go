@@ -0,0 +1,83 @@
+package ratelimiter
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := func(remoteAddr string, headers ...string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		if ip := clientIP(req, trusted); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+
+	t.Run("untrusted peer should be the client", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.Equal("1.2.3.4", ip("1.2.3.4:80", "X-Forwarded-For", "5.6.7.8"))
+		assert.Equal("1.2.3.4", ip("1.2.3.4:80", "X-Real-IP", "5.6.7.8"))
+		assert.Equal("2001:db8::1", ip("[2001:db8::1]:80"))
+		assert.Equal("", ip("bad"))
+	})
+
+	t.Run("X-Forwarded-For should be walked from the right", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.Equal("5.6.7.8", ip("10.0.0.1:80", "X-Forwarded-For", "6.6.6.6, 5.6.7.8, 10.1.1.1"))
+		assert.Equal("5.6.7.8", ip("10.0.0.1:80", "X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "5.6.7.8,192.168.1.1"))
+		assert.Equal("10.1.1.1", ip("10.0.0.1:80", "X-Forwarded-For", "10.2.2.2, bad, 10.1.1.1"))
+		assert.Equal("10.2.2.2", ip("10.0.0.1:80", "X-Forwarded-For", "10.2.2.2"))
+		assert.Equal("192.168.1.2", ip("192.168.1.1:80", "X-Forwarded-For", "192.168.1.2"))
+	})
+
+	t.Run("Forwarded and X-Real-IP should be", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.Equal("2001:db8::1", ip("[fd00::1]:80", "Forwarded", `for="[2001:db8::1]:4711";proto=https, for=10.1.1.1`))
+		assert.Equal("5.6.7.8", ip("10.0.0.1:80", "Forwarded", "For=5.6.7.8:80"))
+		assert.Equal("5.6.7.8", ip("10.0.0.1:80", "X-Real-IP", "5.6.7.8"))
+		assert.Equal("10.0.0.1", ip("10.0.0.1:80", "X-Real-IP", "bad"))
+	})
+
+	t.Run("wrong trusted proxy should error", func(t *testing.T) {
+		_, err := parseCIDRs([]string{"10.0.0.0/33"})
+		assert.Equal(t, `invalid trusted proxy "10.0.0.0/33"`, err.Error())
+		assert.Panics(t, func() { ByIP("localhost") })
+		assert.Panics(t, func() { ByIPNet(129) })
+	})
+
+	t.Run("IPv6 should be aggregated by prefix", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.Equal("2001:db8:1:2::/64", ipID(parseIP("[2001:db8:1:2:3:4:5:6]:80"), 64))
+		assert.Equal("2001:db8::/32", ipID(parseIP("2001:db8:1:2:3:4:5:6"), 32))
+		assert.Equal("2001:db8:1:2:3:4:5:6", ipID(parseIP("2001:db8:1:2:3:4:5:6"), 0))
+		assert.Equal("2001:db8:1:2:3:4:5:6", ipID(parseIP("2001:db8:1:2:3:4:5:6"), 128))
+		assert.Equal("1.2.3.4", ipID(parseIP("1.2.3.4"), 64))
+		assert.Equal("1.2.3.4", ipID(parseIP("::ffff:1.2.3.4"), 64))
+		assert.Equal("", ipID(nil, 64))
+	})
+}
+
+func TestJWTClaim(t *testing.T) {
+	assert := assert.New(t)
+	token := func(payload string) string {
+		return "Bearer x." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".y"
+	}
+	assert.Equal("alice", jwtClaim(token(`{"sub":"alice"}`), "sub"))
+	assert.Equal("12345678901", jwtClaim(token(`{"uid":12345678901}`), "uid"))
+	assert.Equal("", jwtClaim(token(`{"sub":true}`), "sub"))
+	assert.Equal("", jwtClaim(token(`{"sub":"alice"}`), "uid"))
+	assert.Equal("", jwtClaim("Basic YWxpY2U=", "sub"))
+	assert.Equal("", jwtClaim("Bearer x.!.y", "sub"))
+}
@@ -0,0 +1,588 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a format of policy files.
+type Format string
+
+// Formats supported by LoadPolicies and MarshalPolicies.
+const (
+	YAML Format = "yaml"
+	JSON Format = "json"
+	TOML Format = "toml"
+)
+
+// FormatOf returns the format of a file name by its extension, such as "policies.yml".
+func FormatOf(name string) (Format, bool) {
+	switch strings.ToLower(name[strings.LastIndexByte(name, '.')+1:]) {
+	case "yaml", "yml":
+		return YAML, true
+	case "json":
+		return JSON, true
+	case "toml":
+		return TOML, true
+	}
+	return "", false
+}
+
+// LoadPolicies reads policies from a YAML, JSON or TOML file. The schema in YAML:
+//
+//	routes:
+//	  - path: /users/:id          # the path of the policy key, omit it for method-only keys
+//	    methods: [GET, HEAD]      # optional, one policy key for each method
+//	    limits:
+//	      - {max: 10, window: 1s} # windows are durations, such as "500ms", "5s" and "1h"
+//	      - {max: 100, window: 1m}
+//	    algorithm: token-bucket   # optional, Policy.Algorithm
+//	    burst: 5                  # optional, Policy.Burst
+//	    cost: 1                   # optional, Policy.Cost
+//	    key: path                 # optional, "route" (default) or "path"
+//	    headers: none             # optional, "default", "none", "ietf" or "both"
+//	    groups: [heavy]           # optional, names of Options.Groups
+//	    max_delay: 2s             # optional, Policy.MaxDelay
+//	    max_queue: 10             # optional, Policy.MaxQueue
+//	    tiers:                    # optional, limits of customer tiers
+//	      pro:
+//	        - {max: 100, window: 1s}
+//	  - path: /health
+//	    exempt: true              # requests are not limited, limits are not required
+//
+// Problems are returned together by a *ValidationError, with line numbers of the file, or key
+// paths such as "routes[1].cost" for TOML files. Defaults of Options are applied and checked by New or UpdatePolicies.
+func LoadPolicies(r io.Reader, format Format) (map[string]*Policy, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var root *node
+	switch format {
+	case YAML:
+		root, err = parseYAML(data)
+	case JSON:
+		root, err = parseJSON(data)
+	case TOML:
+		root, err = parseTOML(data)
+	default:
+		return nil, fmt.Errorf("ratelimiter: unknown format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ratelimiter: invalid %s, %v", format, err)
+	}
+	return decodePolicies(root)
+}
+
+// MarshalPolicies writes policies in the schema of LoadPolicies, such as for generating docs.
+// Routes are sorted by policy key.
+func MarshalPolicies(policies map[string]*Policy, format Format) ([]byte, error) {
+	config := policiesConfig{Routes: make([]routeConfig, 0, len(policies))}
+	for _, key := range sortedKeys(policies) {
+		p := policies[key]
+		if p == nil {
+			return nil, fmt.Errorf("ratelimiter: policy %q is nil", key)
+		}
+		route := routeConfig{
+			Limits:    toLimitConfigs(p.Limits),
+			Algorithm: string(p.Algorithm),
+			Burst:     p.Burst,
+			Cost:      p.Cost,
+			Exempt:    p.Exempt,
+			Groups:    p.Groups,
+			MaxQueue:  p.MaxQueue,
+		}
+		if p.MaxDelay > 0 {
+			route.MaxDelay = formatDuration(p.MaxDelay)
+		}
+		if !strings.HasPrefix(key, "/") {
+			if i := strings.IndexByte(key, ' '); i < 0 {
+				route.Methods = []string{key}
+			} else {
+				route.Methods, route.Path = []string{key[:i]}, strings.TrimSpace(key[i+1:])
+			}
+		} else {
+			route.Path = key
+		}
+		if p.Key == KeyByPath {
+			route.Key = "path"
+		}
+		switch p.Headers {
+		case HeadersNone:
+			route.Headers = "none"
+		case HeadersIETF:
+			route.Headers = "ietf"
+		case HeadersBoth:
+			route.Headers = "both"
+		}
+		if len(p.Tiers) > 0 {
+			route.Tiers = make(map[string][]limitConfig, len(p.Tiers))
+			for tier, limits := range p.Tiers {
+				route.Tiers[tier] = toLimitConfigs(limits)
+			}
+		}
+		config.Routes = append(config.Routes, route)
+	}
+
+	switch format {
+	case YAML:
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(config); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case JSON:
+		return json.MarshalIndent(config, "", "  ")
+	case TOML:
+		var buf bytes.Buffer
+		encoder := toml.NewEncoder(&buf)
+		encoder.Indent = ""
+		if err := encoder.Encode(config); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("ratelimiter: unknown format %q", format)
+}
+
+// policiesConfig is the schema of policy files.
+type policiesConfig struct {
+	Routes []routeConfig `json:"routes" yaml:"routes" toml:"routes"`
+}
+
+type routeConfig struct {
+	Path      string                   `json:"path,omitempty" yaml:"path,omitempty" toml:"path,omitempty"`
+	Methods   []string                 `json:"methods,omitempty" yaml:"methods,omitempty,flow" toml:"methods,omitempty"`
+	Limits    []limitConfig            `json:"limits,omitempty" yaml:"limits,omitempty" toml:"limits,omitempty"`
+	Algorithm string                   `json:"algorithm,omitempty" yaml:"algorithm,omitempty" toml:"algorithm,omitempty"`
+	Burst     int                      `json:"burst,omitempty" yaml:"burst,omitempty" toml:"burst,omitzero"`
+	Cost      int                      `json:"cost,omitempty" yaml:"cost,omitempty" toml:"cost,omitzero"`
+	Key       string                   `json:"key,omitempty" yaml:"key,omitempty" toml:"key,omitempty"`
+	Headers   string                   `json:"headers,omitempty" yaml:"headers,omitempty" toml:"headers,omitempty"`
+	Tiers     map[string][]limitConfig `json:"tiers,omitempty" yaml:"tiers,omitempty" toml:"tiers,omitempty"`
+	Exempt    bool                     `json:"exempt,omitempty" yaml:"exempt,omitempty" toml:"exempt,omitempty"`
+	Groups    []string                 `json:"groups,omitempty" yaml:"groups,omitempty,flow" toml:"groups,omitempty"`
+	MaxDelay  string                   `json:"max_delay,omitempty" yaml:"max_delay,omitempty" toml:"max_delay,omitempty"`
+	MaxQueue  int                      `json:"max_queue,omitempty" yaml:"max_queue,omitempty" toml:"max_queue,omitzero"`
+}
+
+type limitConfig struct {
+	Max    int    `json:"max" yaml:"max" toml:"max"`
+	Window string `json:"window" yaml:"window" toml:"window"`
+}
+
+func toLimitConfigs(limits []Limit) []limitConfig {
+	configs := make([]limitConfig, len(limits))
+	for i, limit := range limits {
+		configs[i] = limitConfig{Max: limit.Max, Window: formatDuration(limit.Window)}
+	}
+	return configs
+}
+
+// formatDuration formats d like time.Duration.String, without zero units, such as "1m" for "1m0s".
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	listNode
+	objectNode
+)
+
+// node is a value of a policy file with its position, so that errors can point to it.
+type node struct {
+	kind   nodeKind
+	pos    string  // such as "line 5", or the key path in TOML files
+	value  string  // value of a scalar node
+	items  []*node // items of a list node
+	keys   []*node // keys of an object node, they are scalar nodes
+	values []*node // values of an object node
+}
+
+func (n *node) get(key string) *node {
+	for i, k := range n.keys {
+		if k.value == key {
+			return n.values[i]
+		}
+	}
+	return nil
+}
+
+func (n *node) String() string {
+	switch n.kind {
+	case listNode:
+		return "list"
+	case objectNode:
+		return "object"
+	}
+	return strconv.Quote(n.value)
+}
+
+func parseYAML(data []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &node{kind: objectNode, pos: "line 1"}, nil
+	}
+	return fromYAML(doc.Content[0]), nil
+}
+
+func fromYAML(y *yaml.Node) *node {
+	if y.Kind == yaml.AliasNode {
+		y = y.Alias
+	}
+	n := &node{pos: "line " + strconv.Itoa(y.Line)}
+	switch y.Kind {
+	case yaml.SequenceNode:
+		n.kind = listNode
+		for _, item := range y.Content {
+			n.items = append(n.items, fromYAML(item))
+		}
+	case yaml.MappingNode:
+		n.kind = objectNode
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			n.keys = append(n.keys, fromYAML(y.Content[i]))
+			n.values = append(n.values, fromYAML(y.Content[i+1]))
+		}
+	default:
+		if y.Tag != "!!null" {
+			n.value = y.Value
+		}
+	}
+	return n
+}
+
+func parseJSON(data []byte) (*node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	line := func() string {
+		return "line " + strconv.Itoa(bytes.Count(data[:decoder.InputOffset()], []byte("\n"))+1)
+	}
+	var parse func(tok json.Token) (*node, error)
+	parse = func(tok json.Token) (*node, error) {
+		n := &node{pos: line()}
+		switch v := tok.(type) {
+		case json.Delim:
+			if v == '[' {
+				n.kind = listNode
+			} else {
+				n.kind = objectNode
+			}
+			for decoder.More() {
+				tok, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				if n.kind == objectNode {
+					n.keys = append(n.keys, &node{pos: line(), value: tok.(string)})
+					if tok, err = decoder.Token(); err != nil {
+						return nil, err
+					}
+				}
+				item, err := parse(tok)
+				if err != nil {
+					return nil, err
+				}
+				if n.kind == objectNode {
+					n.values = append(n.values, item)
+				} else {
+					n.items = append(n.items, item)
+				}
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+		case nil:
+		default:
+			n.value = fmt.Sprint(v)
+		}
+		return n, nil
+	}
+
+	tok, err := decoder.Token()
+	if err == io.EOF {
+		return &node{kind: objectNode, pos: "line 1"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parse(tok)
+}
+
+// parseTOML parses a TOML file, the decoder doesn't report lines of values,
+// so nodes are positioned by their key paths, such as "routes[1].cost".
+func parseTOML(data []byte) (*node, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return nil, err
+	}
+	return fromTOML(doc, ""), nil
+}
+
+func fromTOML(v interface{}, path string) *node {
+	n := &node{pos: path}
+	switch v := v.(type) {
+	case []map[string]interface{}:
+		n.kind = listNode
+		for i, item := range v {
+			n.items = append(n.items, fromTOML(item, fmt.Sprintf("%s[%d]", path, i)))
+		}
+	case []interface{}:
+		n.kind = listNode
+		for i, item := range v {
+			n.items = append(n.items, fromTOML(item, fmt.Sprintf("%s[%d]", path, i)))
+		}
+	case map[string]interface{}:
+		n.kind = objectNode
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			n.keys = append(n.keys, &node{pos: p, value: key})
+			n.values = append(n.values, fromTOML(v[key], p))
+		}
+	default:
+		n.value = fmt.Sprint(v)
+	}
+	return n
+}
+
+// decodePolicies decodes the schema of LoadPolicies.
+func decodePolicies(root *node) (map[string]*Policy, error) {
+	var errs []error
+	report := func(n *node, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{n.pos}, args...)...))
+	}
+	intOf := func(n *node, name string) int {
+		v, err := strconv.Atoi(n.value)
+		if n.kind != scalarNode || err != nil {
+			report(n, "%s should be an integer, got %s", name, n)
+		}
+		return v
+	}
+	stringsOf := func(n *node, name string) []string {
+		if n.kind == scalarNode {
+			return []string{n.value}
+		}
+		var list []string
+		if n.kind == listNode {
+			for _, item := range n.items {
+				if item.kind != scalarNode {
+					report(item, "%s should be a list of strings", name)
+					return nil
+				}
+				list = append(list, item.value)
+			}
+		} else {
+			report(n, "%s should be a list of strings", name)
+		}
+		return list
+	}
+	limitsOf := func(n *node, name string) []Limit {
+		if n.kind != listNode || len(n.items) == 0 {
+			report(n, "%s should be a list of limits", name)
+			return nil
+		}
+		limits := make([]Limit, 0, len(n.items))
+		for i, item := range n.items {
+			if item.kind != objectNode {
+				report(item, "%s %d should be an object of max and window", name, i)
+				continue
+			}
+			var limit Limit
+			for j, k := range item.keys {
+				v := item.values[j]
+				switch k.value {
+				case "max":
+					if limit.Max = intOf(v, "max"); limit.Max <= 0 && v.kind == scalarNode {
+						report(v, "max should be positive, got %s", v.value)
+					}
+				case "window":
+					d, err := time.ParseDuration(v.value)
+					if v.kind != scalarNode || err != nil {
+						report(v, `window should be a duration such as "5s", got %s`, v)
+					} else if d < time.Millisecond {
+						report(v, "window should be at least 1ms, got %s", v.value)
+					}
+					limit.Window = d
+				default:
+					report(k, "unknown field %q of %s", k.value, name)
+				}
+			}
+			if item.get("max") == nil || item.get("window") == nil {
+				report(item, "%s %d should have max and window", name, i)
+			}
+			limits = append(limits, limit)
+		}
+		return limits
+	}
+
+	policies := make(map[string]*Policy)
+	positions := make(map[string]string)
+	if root.kind != objectNode {
+		report(root, "should be an object of routes")
+		return nil, &ValidationError{Errors: errs, subject: "policies"}
+	}
+	for i, k := range root.keys {
+		if k.value != "routes" {
+			report(k, "unknown field %q", k.value)
+			continue
+		}
+		routes := root.values[i]
+		if routes.kind != listNode {
+			if routes.kind != scalarNode || routes.value != "" {
+				report(routes, "routes should be a list")
+			}
+			continue
+		}
+		for _, route := range routes.items {
+			if route.kind != objectNode {
+				report(route, "route should be an object")
+				continue
+			}
+			p := &Policy{}
+			var path string
+			var methods []string
+			for j, k := range route.keys {
+				v := route.values[j]
+				switch k.value {
+				case "path":
+					if path = v.value; !strings.HasPrefix(path, "/") {
+						report(v, `path should start with "/", got %s`, v)
+						path = ""
+					}
+				case "methods":
+					methods = stringsOf(v, k.value)
+				case "limits":
+					p.Limits = limitsOf(v, "limit")
+				case "algorithm":
+					p.Algorithm = Algorithm(v.value)
+					if err := (&Policy{Limits: []Limit{{1, time.Second}}, Algorithm: p.Algorithm}).validate(); err != nil {
+						report(v, "%v", err)
+					}
+				case "burst":
+					if p.Burst = intOf(v, "burst"); p.Burst < 0 {
+						report(v, "burst should not be negative, got %d", p.Burst)
+					}
+				case "cost":
+					if p.Cost = intOf(v, "cost"); p.Cost < 0 {
+						report(v, "cost should not be negative, got %d", p.Cost)
+					}
+				case "key":
+					switch v.value {
+					case "route":
+					case "path":
+						p.Key = KeyByPath
+					default:
+						report(v, `key should be "route" or "path", got %s`, v)
+					}
+				case "headers":
+					switch v.value {
+					case "default":
+					case "none":
+						p.Headers = HeadersNone
+					case "ietf":
+						p.Headers = HeadersIETF
+					case "both":
+						p.Headers = HeadersBoth
+					default:
+						report(v, `headers should be "default", "none", "ietf" or "both", got %s`, v)
+					}
+				case "tiers":
+					if v.kind != objectNode {
+						report(v, "tiers should be an object of tier limits")
+						continue
+					}
+					p.Tiers = make(map[string][]Limit, len(v.keys))
+					for t, tier := range v.keys {
+						if tier.value == "" {
+							report(tier, "tier name should not be empty")
+						}
+						p.Tiers[tier.value] = limitsOf(v.values[t], fmt.Sprintf("tier %q limit", tier.value))
+					}
+				case "groups":
+					p.Groups = stringsOf(v, k.value)
+				case "max_delay":
+					d, err := time.ParseDuration(v.value)
+					if v.kind != scalarNode || err != nil || d < 0 {
+						report(v, `max_delay should be a duration such as "5s", got %s`, v)
+					}
+					p.MaxDelay = d
+				case "max_queue":
+					if p.MaxQueue = intOf(v, "max_queue"); p.MaxQueue < 0 {
+						report(v, "max_queue should not be negative, got %d", p.MaxQueue)
+					}
+				case "exempt":
+					exempt, err := strconv.ParseBool(v.value)
+					if v.kind != scalarNode || err != nil {
+						report(v, "exempt should be true or false, got %s", v)
+					}
+					p.Exempt = exempt
+				default:
+					report(k, "unknown field %q of route", k.value)
+				}
+			}
+			if route.get("limits") == nil && !p.Exempt {
+				report(route, "route should have limits")
+			}
+			if path == "" && len(methods) == 0 {
+				if route.get("path") == nil {
+					report(route, "route should have path or methods")
+				}
+				continue
+			}
+
+			keys := []string{path}
+			if len(methods) > 0 {
+				keys = keys[:0]
+				for _, method := range methods {
+					keys = append(keys, strings.TrimSpace(method+" "+path))
+				}
+			}
+			for _, key := range keys {
+				if _, err := compileRoute(key); err != nil {
+					report(route, "%v", err)
+				} else if pos, ok := positions[key]; ok {
+					report(route, "policy key %q is already defined at %s", key, pos)
+				} else {
+					positions[key] = route.pos
+					policies[key] = p
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs, subject: "policies"}
+	}
+	return policies, nil
+}
@@ -0,0 +1,217 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	expected := map[string]*Policy{
+		"GET /users/:id": &Policy{
+			Limits: []Limit{{10, time.Second}, {100, time.Minute}},
+			Tiers:  map[string][]Limit{"pro": {{100, time.Second}}},
+		},
+		"HEAD /users/:id": nil, // the same as "GET /users/:id"
+		"POST /import": &Policy{
+			Limits:    []Limit{{10, 90 * time.Minute}},
+			Algorithm: TokenBucket,
+			Burst:     3,
+			Cost:      2,
+			Key:       KeyByPath,
+			Headers:   HeadersNone,
+			Groups:    []string{"heavy", "writes"},
+			MaxDelay:  2 * time.Second,
+			MaxQueue:  5,
+		},
+		"/health": &Policy{Exempt: true},
+	}
+	expected["HEAD /users/:id"] = expected["GET /users/:id"]
+
+	files := map[Format]string{
+		YAML: `
+routes:
+  - path: /users/:id
+    methods: [GET, HEAD]
+    limits:
+      - {max: 10, window: 1s}
+      - max: 100
+        window: 1m
+    tiers:
+      pro:
+        - {max: 100, window: 1s}
+  - path: /import
+    methods: POST
+    limits: [{max: 10, window: 1h30m}]
+    algorithm: token-bucket
+    burst: 3
+    cost: 2
+    key: path
+    headers: none
+    groups: [heavy, writes]
+    max_delay: 2s
+    max_queue: 5
+  - path: /health
+    exempt: true
+`,
+		JSON: `{
+  "routes": [
+    {
+      "path": "/users/:id",
+      "methods": ["GET", "HEAD"],
+      "limits": [{"max": 10, "window": "1s"}, {"max": 100, "window": "1m"}],
+      "tiers": {"pro": [{"max": 100, "window": "1s"}]}
+    },
+    {
+      "path": "/import",
+      "methods": ["POST"],
+      "limits": [{"max": 10, "window": "1h30m"}],
+      "algorithm": "token-bucket",
+      "burst": 3,
+      "cost": 2,
+      "key": "path",
+      "headers": "none",
+      "groups": ["heavy", "writes"],
+      "max_delay": "2s",
+      "max_queue": 5
+    },
+    {"path": "/health", "exempt": true}
+  ]
+}`,
+		TOML: `
+# policies of the api
+[[routes]]
+path = "/users/:id"
+methods = ["GET", 'HEAD']
+limits = [
+  {max = 10, window = "1s"}, # per second
+  {max = 1_00, window = "1m"},
+]
+[routes.tiers]
+pro = [{max = 100, window = "1s"}]
+
+[[routes]]
+path = "/import"
+methods = ["POST"]
+limits = [{max = 10, window = "1h30m"}]
+algorithm = "token-bucket"
+burst = 3
+cost = 2
+key = "path"
+headers = "none"
+groups = ["heavy", "writes"]
+max_delay = "2s"
+max_queue = 5
+
+[[routes]]
+path = "/health"
+exempt = true
+`,
+	}
+
+	for format, file := range files {
+		t.Run(string(format)+" should be loaded", func(t *testing.T) {
+			assert := assert.New(t)
+			policies, err := LoadPolicies(strings.NewReader(file), format)
+			assert.Nil(err)
+			assert.Equal(expected, policies)
+
+			// round trip
+			data, err := MarshalPolicies(policies, format)
+			assert.Nil(err)
+			policies, err = LoadPolicies(bytes.NewReader(data), format)
+			assert.Nil(err)
+			assert.Equal(expected, policies)
+		})
+	}
+
+	t.Run("empty file should be loaded", func(t *testing.T) {
+		for _, format := range []Format{YAML, JSON, TOML} {
+			policies, err := LoadPolicies(strings.NewReader(""), format)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(policies))
+		}
+	})
+
+	t.Run("MarshalPolicies should be", func(t *testing.T) {
+		assert := assert.New(t)
+		data, err := MarshalPolicies(map[string]*Policy{
+			"GET": &Policy{Limits: []Limit{{5, 2 * time.Second}}},
+		}, YAML)
+		assert.Nil(err)
+		assert.Equal("routes:\n  - methods: [GET]\n    limits:\n      - max: 5\n        window: 2s\n", string(data))
+		data, err = MarshalPolicies(map[string]*Policy{
+			"/a": &Policy{Limits: []Limit{{5, time.Hour}}, Tiers: map[string][]Limit{"pro plan": {{50, time.Hour}}}},
+		}, TOML)
+		assert.Nil(err)
+		assert.Equal("[[routes]]\npath = \"/a\"\n\n[[routes.limits]]\nmax = 5\nwindow = \"1h\"\n"+
+			"[routes.tiers]\n\n[[routes.tiers.\"pro plan\"]]\nmax = 50\nwindow = \"1h\"\n", string(data))
+		_, err = MarshalPolicies(nil, "xml")
+		assert.Equal(`ratelimiter: unknown format "xml"`, err.Error())
+	})
+
+	t.Run("errors should have line numbers", func(t *testing.T) {
+		assert := assert.New(t)
+		_, err := LoadPolicies(strings.NewReader(`
+routes:
+  - path: /a
+    limits:
+      - {max: 0, window: 1s}
+      - {max: 1, window: 5}
+  - path: users
+    limits: [{max: 1, window: 1s}]
+  - path: /a
+    limits: [{max: 1, window: 1s, burst: 2}]
+    algorithm: leaky
+  - methods: [GET]
+    key: id
+    cost: many
+  - path: /b
+    tiers: {pro: [{max: 1}]}
+`), YAML)
+		assert.Equal(`ratelimiter: invalid policies: line 5: max should be positive, got 0; `+
+			`line 6: window should be a duration such as "5s", got "5"; `+
+			`line 7: path should start with "/", got "users"; `+
+			`line 10: unknown field "burst" of limit; `+
+			`line 11: unknown algorithm "leaky"; `+
+			`line 9: policy key "/a" is already defined at line 3; `+
+			`line 13: key should be "route" or "path", got "id"; `+
+			`line 14: cost should be an integer, got "many"; `+
+			`line 12: route should have limits; `+
+			`line 16: tier "pro" limit 0 should have max and window; `+
+			`line 15: route should have limits`, err.Error())
+
+		_, err = LoadPolicies(strings.NewReader("{\n  \"routes\": [\n    {\"path\": \"/a\", \"limits\": [{\"max\": 1, \"window\": \"1x\"}]}\n  ]\n}"), JSON)
+		assert.Equal(`ratelimiter: invalid policies: line 3: window should be a duration such as "5s", got "1x"`, err.Error())
+
+		_, err = LoadPolicies(strings.NewReader("[[routes]]\npath = \"/a\"\n\nlimits = [{max = 1, window = \"1s\"}]\nexempt = \"yes\"\n"), TOML)
+		assert.Equal(`ratelimiter: invalid policies: routes[0].exempt: exempt should be true or false, got "yes"`, err.Error())
+
+		_, err = LoadPolicies(strings.NewReader("[[routes]]\npath = \"/a\"\npath = \"/b\"\n"), TOML)
+		assert.Contains(err.Error(), `ratelimiter: invalid toml, toml: line 3 (last key "routes.path")`)
+		_, err = LoadPolicies(strings.NewReader("routes = [\n  {max = 1 window = 2},\n]"), TOML)
+		assert.Contains(err.Error(), `ratelimiter: invalid toml, toml: line 2`)
+		_, err = LoadPolicies(strings.NewReader("routes: [\n"), YAML)
+		assert.Contains(err.Error(), "ratelimiter: invalid yaml, ")
+		_, err = LoadPolicies(strings.NewReader(`{"routes": [{"limits": [{"max": 1, "window": "1s"}]}]}`), JSON)
+		assert.Equal(`ratelimiter: invalid policies: line 1: route should have path or methods`, err.Error())
+		_, err = LoadPolicies(strings.NewReader("[]"), JSON)
+		assert.Equal(`ratelimiter: invalid policies: line 1: should be an object of routes`, err.Error())
+		_, err = LoadPolicies(strings.NewReader(""), "xml")
+		assert.Equal(`ratelimiter: unknown format "xml"`, err.Error())
+	})
+
+	t.Run("FormatOf should be", func(t *testing.T) {
+		assert := assert.New(t)
+		for name, format := range map[string]Format{"a.yml": YAML, "b/a.YAML": YAML, "a.json": JSON, "a.toml": TOML} {
+			f, ok := FormatOf(name)
+			assert.True(ok)
+			assert.Equal(format, f)
+		}
+		_, ok := FormatOf("policies")
+		assert.False(ok)
+	})
+}
@@ -0,0 +1,255 @@
+package ratelimiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// memoryItem keeps the state of a key, fields are used by different algorithms.
+type memoryItem struct {
+	expire time.Time
+	start  time.Time // window start of FixedWindow and SlidingWindow
+	count  int       // count of current window
+	prev   int       // count of previous window of SlidingWindow
+	tokens float64   // tokens of TokenBucket
+	last   time.Time // last refill of TokenBucket, or theoretical arrival time of GCRA
+	log    []logEntry
+}
+
+type logEntry struct {
+	at   time.Time
+	cost int
+}
+
+type memoryStore struct {
+	mu    sync.Mutex
+	items map[string]*memoryItem
+	sweep time.Time
+}
+
+// NewMemoryStore returns a Store keeping states in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{items: make(map[string]*memoryItem), sweep: time.Now().Add(time.Minute)}
+}
+
+func (s *memoryStore) Take(req Request) (Usage, error) {
+	us, err := s.TakeAll([]Request{req})
+	if err != nil {
+		return Usage{}, err
+	}
+	return us[0], nil
+}
+
+func (s *memoryStore) TakeAll(reqs []Request) ([]Usage, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.After(s.sweep) {
+		for key, item := range s.items {
+			if now.After(item.expire) {
+				delete(s.items, key)
+			}
+		}
+		s.sweep = now.Add(time.Minute)
+	}
+	// requests are run on copies of the items, which are kept only if all are allowed,
+	// and taken by a request with a cost.
+	items := make(map[string]*memoryItem, len(reqs))
+	taken := make(map[string]bool, len(reqs))
+	us := make([]Usage, len(reqs))
+	allowed := true
+	for i := range reqs {
+		item, ok := items[reqs[i].Key]
+		if !ok {
+			item = &memoryItem{}
+			if v, ok := s.items[reqs[i].Key]; ok && !now.After(v.expire) {
+				*item = *v
+				item.log = append([]logEntry(nil), v.log...)
+			}
+			items[reqs[i].Key] = item
+		}
+		u, err := takeItem(item, &reqs[i], now)
+		if err != nil {
+			return nil, err
+		}
+		us[i] = u
+		allowed = allowed && u.Allowed
+		taken[reqs[i].Key] = taken[reqs[i].Key] || reqs[i].Cost > 0
+	}
+	if allowed {
+		for key, item := range items {
+			if taken[key] {
+				s.items[key] = item
+			}
+		}
+	}
+	return us, nil
+}
+
+func (s *memoryStore) Refund(reqs []Request) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range reqs {
+		if item, ok := s.items[reqs[i].Key]; ok && !now.After(item.expire) {
+			refundItem(item, &reqs[i])
+		}
+	}
+	return nil
+}
+
+// refundItem gives the cost of req back to item.
+func refundItem(item *memoryItem, req *Request) {
+	burst := req.Burst
+	if burst <= 0 {
+		burst = req.Limit.Max
+	}
+	switch req.Algorithm {
+	case FixedWindow, SlidingWindow:
+		if item.count -= req.Cost; item.count < 0 {
+			item.count = 0
+		}
+	case SlidingLog:
+		// remove the latest entry of the cost
+		for i := len(item.log) - 1; i >= 0; i-- {
+			if item.log[i].cost == req.Cost {
+				item.log = append(item.log[:i], item.log[i+1:]...)
+				break
+			}
+		}
+	case TokenBucket:
+		item.tokens = math.Min(item.tokens+float64(req.Cost), float64(burst))
+	case GCRA:
+		item.last = item.last.Add(-time.Duration(req.Cost) * (req.Limit.Window / time.Duration(req.Limit.Max)))
+	}
+}
+
+// takeItem runs the algorithm of req on item.
+func takeItem(item *memoryItem, req *Request, now time.Time) (u Usage, err error) {
+	max, window := req.Limit.Max, req.Limit.Window
+	burst := req.Burst
+	if burst <= 0 {
+		burst = max
+	}
+
+	switch req.Algorithm {
+	case FixedWindow:
+		if item.start.IsZero() {
+			item.start = now
+		}
+		u.Total = max
+		u.Reset = item.start.Add(window)
+		if u.Allowed = item.count+req.Cost <= max; u.Allowed {
+			item.count += req.Cost
+		} else {
+			u.RetryAfter = u.Reset.Sub(now)
+		}
+		u.Remaining = max - item.count
+		item.expire = u.Reset
+
+	case SlidingWindow:
+		start := now.Truncate(window)
+		if !item.start.Equal(start) {
+			if item.start.Add(window).Equal(start) {
+				item.prev = item.count
+			} else {
+				item.prev = 0
+			}
+			item.start, item.count = start, 0
+		}
+		weight := 1 - float64(now.Sub(start))/float64(window)
+		used := int(math.Ceil(float64(item.prev)*weight)) + item.count
+		u.Total = max
+		u.Reset = start.Add(window)
+		if u.Allowed = used+req.Cost <= max; u.Allowed {
+			item.count += req.Cost
+			used += req.Cost
+		} else if free := max - req.Cost - item.count; free >= 0 && item.prev > 0 {
+			// wait until the weighted previous count drops to free
+			u.RetryAfter = time.Duration((1-float64(free)/float64(item.prev))*float64(window)) - now.Sub(start)
+		} else {
+			u.RetryAfter = u.Reset.Sub(now)
+		}
+		if u.Remaining = max - used; u.Remaining < 0 {
+			u.Remaining = 0
+		}
+		item.expire = start.Add(2 * window)
+
+	case SlidingLog:
+		used, i := 0, 0
+		for ; i < len(item.log) && !item.log[i].at.Add(window).After(now); i++ {
+		}
+		item.log = item.log[i:]
+		for _, e := range item.log {
+			used += e.cost
+		}
+		u.Total = max
+		if u.Allowed = used+req.Cost <= max; u.Allowed {
+			item.log = append(item.log, logEntry{at: now, cost: req.Cost})
+			used += req.Cost
+		} else {
+			// wait until enough entries drop out of the window
+			need := used + req.Cost - max
+			for _, e := range item.log {
+				if need -= e.cost; need <= 0 {
+					u.RetryAfter = e.at.Add(window).Sub(now)
+					break
+				}
+			}
+			if need > 0 {
+				u.RetryAfter = window
+			}
+		}
+		if u.Remaining = max - used; u.Remaining < 0 {
+			u.Remaining = 0
+		}
+		u.Reset = now
+		if n := len(item.log); n > 0 {
+			u.Reset = item.log[n-1].at.Add(window)
+		}
+		item.expire = u.Reset
+
+	case TokenBucket:
+		rate := float64(max) / float64(window) // tokens per nanosecond
+		if item.last.IsZero() {
+			item.tokens = float64(burst)
+		} else if item.tokens += float64(now.Sub(item.last)) * rate; item.tokens > float64(burst) {
+			item.tokens = float64(burst)
+		}
+		item.last = now
+		u.Total = burst
+		if u.Allowed = item.tokens >= float64(req.Cost); u.Allowed {
+			item.tokens -= float64(req.Cost)
+		} else {
+			u.RetryAfter = time.Duration((float64(req.Cost) - item.tokens) / rate)
+		}
+		u.Remaining = int(item.tokens)
+		u.Reset = now.Add(time.Duration((float64(burst) - item.tokens) / rate))
+		item.expire = u.Reset
+
+	case GCRA:
+		interval := window / time.Duration(max)
+		tat := item.last
+		if tat.Before(now) {
+			tat = now
+		}
+		next := tat.Add(time.Duration(req.Cost) * interval)
+		allowAt := next.Add(-time.Duration(burst) * interval)
+		u.Total = burst
+		if u.Allowed = !now.Before(allowAt); u.Allowed {
+			tat = next
+		} else {
+			u.RetryAfter = allowAt.Sub(now)
+		}
+		item.last = tat
+		u.Remaining = int((now.Add(time.Duration(burst) * interval).Sub(tat)) / interval)
+		u.Reset = tat
+		item.expire = tat
+
+	default:
+		return u, errUnknownAlgorithm
+	}
+	return u, nil
+}
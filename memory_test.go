@@ -0,0 +1,177 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	run := func(item *memoryItem, alg Algorithm, max int, window time.Duration, burst, cost int, at time.Duration) Usage {
+		u, err := takeItem(item, &Request{
+			Algorithm: alg,
+			Limit:     Limit{Max: max, Window: window},
+			Burst:     burst,
+			Cost:      cost,
+		}, now.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	t.Run("FixedWindow should be", func(t *testing.T) {
+		assert := assert.New(t)
+		item := &memoryItem{}
+		u := run(item, FixedWindow, 3, time.Second, 0, 1, 0)
+		assert.True(u.Allowed)
+		assert.Equal(3, u.Total)
+		assert.Equal(2, u.Remaining)
+		assert.Equal(now.Add(time.Second), u.Reset)
+		u = run(item, FixedWindow, 3, time.Second, 0, 2, 100*time.Millisecond)
+		assert.True(u.Allowed)
+		assert.Equal(0, u.Remaining)
+		u = run(item, FixedWindow, 3, time.Second, 0, 1, 200*time.Millisecond)
+		assert.False(u.Allowed)
+		assert.Equal(0, u.Remaining)
+		assert.Equal(800*time.Millisecond, u.RetryAfter)
+	})
+
+	t.Run("SlidingWindow should be", func(t *testing.T) {
+		assert := assert.New(t)
+		item := &memoryItem{}
+		for i := 0; i < 4; i++ {
+			assert.True(run(item, SlidingWindow, 4, time.Second, 0, 1, 500*time.Millisecond).Allowed)
+		}
+		u := run(item, SlidingWindow, 4, time.Second, 0, 1, 900*time.Millisecond)
+		assert.False(u.Allowed)
+		assert.Equal(100*time.Millisecond, u.RetryAfter)
+		// a quarter of the previous window remains in the sliding window
+		u = run(item, SlidingWindow, 4, time.Second, 0, 1, 1750*time.Millisecond)
+		assert.True(u.Allowed)
+		assert.Equal(2, u.Remaining)
+	})
+
+	t.Run("SlidingLog should be", func(t *testing.T) {
+		assert := assert.New(t)
+		item := &memoryItem{}
+		assert.True(run(item, SlidingLog, 3, time.Second, 0, 1, 0).Allowed)
+		assert.True(run(item, SlidingLog, 3, time.Second, 0, 2, 300*time.Millisecond).Allowed)
+		u := run(item, SlidingLog, 3, time.Second, 0, 1, 600*time.Millisecond)
+		assert.False(u.Allowed)
+		assert.Equal(400*time.Millisecond, u.RetryAfter)
+		assert.Equal(now.Add(1300*time.Millisecond), u.Reset)
+		u = run(item, SlidingLog, 3, time.Second, 0, 1, time.Second)
+		assert.True(u.Allowed)
+		assert.Equal(0, u.Remaining)
+	})
+
+	t.Run("TokenBucket should be", func(t *testing.T) {
+		assert := assert.New(t)
+		item := &memoryItem{}
+		u := run(item, TokenBucket, 10, time.Second, 5, 5, 0)
+		assert.True(u.Allowed)
+		assert.Equal(5, u.Total)
+		assert.Equal(0, u.Remaining)
+		assert.Equal(now.Add(500*time.Millisecond), u.Reset)
+		u = run(item, TokenBucket, 10, time.Second, 5, 2, 110*time.Millisecond)
+		assert.False(u.Allowed)
+		assert.Equal(1, u.Remaining)
+		assert.InDelta(float64(90*time.Millisecond), float64(u.RetryAfter), float64(time.Microsecond))
+		u = run(item, TokenBucket, 10, time.Second, 5, 2, 250*time.Millisecond)
+		assert.True(u.Allowed)
+		assert.Equal(0, u.Remaining)
+	})
+
+	t.Run("GCRA should be", func(t *testing.T) {
+		assert := assert.New(t)
+		item := &memoryItem{}
+		u := run(item, GCRA, 10, time.Second, 2, 1, 0)
+		assert.True(u.Allowed)
+		assert.Equal(2, u.Total)
+		assert.Equal(1, u.Remaining)
+		assert.True(run(item, GCRA, 10, time.Second, 2, 1, 0).Allowed)
+		u = run(item, GCRA, 10, time.Second, 2, 1, 50*time.Millisecond)
+		assert.False(u.Allowed)
+		assert.Equal(0, u.Remaining)
+		assert.Equal(50*time.Millisecond, u.RetryAfter)
+		u = run(item, GCRA, 10, time.Second, 2, 1, 100*time.Millisecond)
+		assert.True(u.Allowed)
+		assert.Equal(0, u.Remaining)
+	})
+
+	t.Run("TakeAll should be atomic", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryStore().(BatchStore)
+		reqs := []Request{
+			{Key: "a", Algorithm: FixedWindow, Limit: Limit{3, time.Minute}, Cost: 1},
+			{Key: "b", Algorithm: TokenBucket, Limit: Limit{2, time.Minute}, Cost: 1},
+		}
+		us, err := store.TakeAll(reqs)
+		assert.Nil(err)
+		assert.Equal(2, us[0].Remaining)
+		assert.Equal(1, us[1].Remaining)
+		_, err = store.TakeAll(reqs)
+		assert.Nil(err)
+		// "b" is exhausted, so "a" is not taken
+		us, err = store.TakeAll(reqs)
+		assert.Nil(err)
+		assert.True(us[0].Allowed)
+		assert.False(us[1].Allowed)
+		u, err := store.Take(reqs[0])
+		assert.Nil(err)
+		assert.Equal(0, u.Remaining)
+
+		_, err = store.TakeAll([]Request{reqs[0], {Key: "c", Algorithm: "x", Limit: Limit{1, time.Second}, Cost: 1}})
+		assert.Equal(errUnknownAlgorithm, err)
+		u, err = store.Take(reqs[0])
+		assert.Nil(err)
+		assert.False(u.Allowed)
+	})
+
+	t.Run("cost 0 should not change keys", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryStore().(*memoryStore)
+		for _, alg := range []Algorithm{FixedWindow, SlidingWindow, SlidingLog, TokenBucket, GCRA} {
+			u, err := store.Take(Request{Key: string(alg), Algorithm: alg, Limit: Limit{2, time.Minute}})
+			assert.Nil(err)
+			assert.True(u.Allowed)
+			assert.Equal(2, u.Remaining)
+		}
+		assert.Equal(0, len(store.items))
+	})
+
+	t.Run("Refund should give back costs", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryStore().(RefundStore)
+		for _, alg := range []Algorithm{FixedWindow, SlidingWindow, SlidingLog, TokenBucket, GCRA} {
+			req := Request{Key: string(alg), Algorithm: alg, Limit: Limit{2, time.Minute}, Cost: 1}
+			for i := 0; i < 2; i++ {
+				u, err := store.Take(req)
+				assert.Nil(err)
+				assert.True(u.Allowed, alg)
+			}
+			u, _ := store.Take(req)
+			assert.False(u.Allowed, alg)
+			assert.Nil(store.Refund([]Request{req}))
+			u, _ = store.Take(req)
+			assert.True(u.Allowed, alg)
+			assert.Equal(0, u.Remaining, alg)
+
+			// counts don't go below zero
+			assert.Nil(store.Refund([]Request{req, req, req}))
+			u, _ = store.Take(req)
+			assert.True(u.Allowed, alg)
+			assert.Equal(1, u.Remaining, alg)
+		}
+		assert.Nil(store.Refund([]Request{{Key: "x", Algorithm: FixedWindow, Limit: Limit{2, time.Minute}, Cost: 1}}))
+		assert.Equal(5, len(store.(*memoryStore).items))
+	})
+
+	t.Run("unknown algorithm should error", func(t *testing.T) {
+		_, err := NewMemoryStore().Take(Request{Key: "a", Algorithm: "x", Limit: Limit{1, time.Second}, Cost: 1})
+		assert.Equal(t, errUnknownAlgorithm, err)
+	})
+}
@@ -0,0 +1,193 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of a pattern segment, ordered from the least to the most specific.
+const (
+	segWildcard = iota // "*" or ":name*", matches the rest of the path
+	segParam           // ":name", matches any non-empty single segment
+	segRegexp          // ":name(regexp)", matches a single segment by regexp
+	segStatic          // plain text, matches itself
+)
+
+type segment struct {
+	kind  int
+	value string
+	re    *regexp.Regexp
+}
+
+func (s *segment) match(val string) bool {
+	switch s.kind {
+	case segStatic:
+		return s.value == val
+	case segRegexp:
+		return s.re.MatchString(val)
+	case segParam:
+		return val != ""
+	}
+	return true
+}
+
+// route is a compiled policy key, such as "GET /users/:id", "/files/*" or "POST".
+type route struct {
+	key      string
+	method   string    // empty matches any method
+	segments []segment // nil matches any path
+	static   bool
+}
+
+func (r *route) match(method string, segs []string) bool {
+	if r.method != "" && r.method != method {
+		return false
+	}
+	if r.segments == nil {
+		return true
+	}
+	n := len(r.segments)
+	if r.segments[n-1].kind == segWildcard {
+		if len(segs) < n {
+			return false
+		}
+	} else if len(segs) != n {
+		return false
+	}
+	for i := range r.segments {
+		if !r.segments[i].match(segs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether r should be tried before o. Segments are compared
+// from left to right (static > regexp > param > wildcard), so "/users/me" beats
+// "/users/:id" which beats "/users/*"; a key with method beats the same path without one,
+// and a method-only key is tried last.
+func (r *route) moreSpecific(o *route) bool {
+	if (r.segments == nil) != (o.segments == nil) {
+		return o.segments == nil
+	}
+	for i := 0; i < len(r.segments) && i < len(o.segments); i++ {
+		if a, b := r.segments[i].kind, o.segments[i].kind; a != b {
+			return a > b
+		}
+	}
+	if len(r.segments) != len(o.segments) {
+		return len(r.segments) > len(o.segments)
+	}
+	if (r.method == "") != (o.method == "") {
+		return o.method == ""
+	}
+	return r.key < o.key
+}
+
+var methods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func compileRoute(key string) (*route, error) {
+	if key == "" {
+		return nil, fmt.Errorf("empty policy key")
+	}
+	r := &route{key: key, static: true}
+	path := key
+	if !strings.HasPrefix(key, "/") {
+		i := strings.IndexByte(key, ' ')
+		if i < 0 {
+			r.method = key
+		} else {
+			r.method, path = key[:i], key[i+1:]
+		}
+		if !methods[r.method] {
+			return nil, fmt.Errorf("invalid policy key %q, unknown method %q", key, r.method)
+		}
+		// the matcher indexes static keys as they are, so "GET  /a" would never match
+		if path != strings.TrimSpace(path) {
+			return nil, fmt.Errorf("invalid policy key %q, method and path should be separated by one space", key)
+		}
+		if i < 0 {
+			return r, nil
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid policy key %q, path should start with \"/\"", key)
+	}
+
+	parts := strings.Split(path[1:], "/")
+	r.segments = make([]segment, len(parts))
+	for i, part := range parts {
+		seg := &r.segments[i]
+		switch {
+		case part == "*" || (strings.HasPrefix(part, ":") && strings.HasSuffix(part, "*")):
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("invalid policy key %q, wildcard should be the last segment", key)
+			}
+			seg.kind = segWildcard
+		case strings.HasPrefix(part, ":"):
+			seg.kind = segParam
+			if j := strings.IndexByte(part, '('); j > 0 && strings.HasSuffix(part, ")") {
+				re, err := regexp.Compile("^(?:" + part[j+1:len(part)-1] + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("invalid policy key %q, %v", key, err)
+				}
+				seg.kind, seg.re = segRegexp, re
+			}
+		default:
+			seg.kind, seg.value = segStatic, part
+		}
+		if seg.kind != segStatic {
+			r.static = false
+		}
+	}
+	return r, nil
+}
+
+// matcher finds the most specific policy key for a request.
+type matcher struct {
+	exact  map[string]*route // static keys, indexed by themselves
+	routes []*route          // pattern and method-only keys, the most specific first
+}
+
+func newMatcher(keys []string) (*matcher, error) {
+	m := &matcher{exact: make(map[string]*route)}
+	for _, key := range keys {
+		r, err := compileRoute(key)
+		if err != nil {
+			return nil, err
+		}
+		if r.static && r.segments != nil {
+			m.exact[key] = r
+		} else {
+			m.routes = append(m.routes, r)
+		}
+	}
+	sort.Slice(m.routes, func(i, j int) bool {
+		return m.routes[i].moreSpecific(m.routes[j])
+	})
+	return m, nil
+}
+
+func (m *matcher) match(method, path string) *route {
+	if r, ok := m.exact[method+" "+path]; ok {
+		return r
+	}
+	if r, ok := m.exact[path]; ok {
+		return r
+	}
+	if len(m.routes) == 0 {
+		return nil
+	}
+	segs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, r := range m.routes {
+		if r.match(method, segs) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package ratelimiter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	t.Run("matcher should pick the most specific key", func(t *testing.T) {
+		assert := assert.New(t)
+		m, err := newMatcher([]string{
+			"GET",
+			"/",
+			"/users/*",
+			"/users/:id",
+			"GET /users/:id",
+			"/users/:id(^\\d+$)",
+			"/users/me",
+			"GET /users/:id/repos",
+			"/files/:path*",
+		})
+		assert.Nil(err)
+
+		cases := [][3]string{
+			{"GET", "/", "/"},
+			{"GET", "/users/me", "/users/me"},
+			{"GET", "/users/123", "/users/:id(^\\d+$)"},
+			{"GET", "/users/abc", "GET /users/:id"},
+			{"PUT", "/users/abc", "/users/:id"},
+			{"GET", "/users/abc/repos", "GET /users/:id/repos"},
+			{"PUT", "/users/abc/repos", "/users/*"},
+			{"GET", "/files/a/b/c.txt", "/files/:path*"},
+			{"GET", "/files", "GET"},
+			{"GET", "/other", "GET"},
+		}
+		for _, c := range cases {
+			r := m.match(c[0], c[1])
+			if assert.NotNil(r, c[0]+" "+c[1]) {
+				assert.Equal(c[2], r.key, c[0]+" "+c[1])
+			}
+		}
+		assert.Nil(m.match("POST", "/other"))
+		// a param doesn't match an empty segment
+		r := m.match("PUT", "/users/")
+		if assert.NotNil(r) {
+			assert.Equal("/users/*", r.key)
+		}
+	})
+
+	t.Run("matcher with invalid keys should error", func(t *testing.T) {
+		assert := assert.New(t)
+		_, err := newMatcher([]string{"GET users"})
+		assert.NotNil(err)
+		_, err = newMatcher([]string{"/files/*/a"})
+		assert.NotNil(err)
+		_, err = newMatcher([]string{"/users/:id(^[0-9$)"})
+		assert.NotNil(err)
+		_, err = newMatcher([]string{"GET  /a"})
+		assert.Equal(`invalid policy key "GET  /a", method and path should be separated by one space`, err.Error())
+		_, err = newMatcher([]string{"GET /a "})
+		assert.NotNil(err)
+	})
+}
@@ -0,0 +1,323 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teambition/gear"
+)
+
+// KeyStrategy decides how the limiter key of a request is built.
+type KeyStrategy int
+
+const (
+	// KeyByRoute shares one limiter key per client for all requests matching the policy key,
+	// so "/users/123" and "/users/456" both count for "/users/:id". It is the default.
+	KeyByRoute KeyStrategy = iota
+	// KeyByPath uses one limiter key per client, method and request path.
+	KeyByPath
+)
+
+// HeaderMode decides which rate limit headers are set on responses.
+type HeaderMode int
+
+const (
+	// HeadersDefault uses Options.Headers, if it is HeadersDefault too, it sets X-Ratelimit-Limit,
+	// X-Ratelimit-Remaining, X-Ratelimit-Reset (Unix time), and Retry-After when the request is limited.
+	HeadersDefault HeaderMode = iota
+	// HeadersNone sets no rate limit headers, for internal endpoints.
+	HeadersNone
+	// HeadersIETF sets the headers of the IETF draft instead: RateLimit-Limit, RateLimit-Remaining,
+	// RateLimit-Reset (seconds from now), RateLimit-Policy with all limits of the policy, such as
+	// "10;w=60, 100;w=3600", and Retry-After when the request is limited.
+	HeadersIETF
+	// HeadersBoth sets the headers of HeadersDefault and HeadersIETF.
+	HeadersBoth
+)
+
+// Policy is the limiter policy of a policy key.
+type Policy struct {
+	// Limits of the policy, such as []Limit{{10, time.Second}, {100, time.Minute}}.
+	// With Default algorithm, they are applied in turn when the client keeps exceeding them,
+	// with other algorithms, they are checked together and their windows should be distinct.
+	Limits []Limit
+	// Tiers are the limits of customer tiers returned by Options.GetTier, such as
+	// {"pro": {{100, time.Second}}}. Tiers not listed use Limits.
+	Tiers map[string][]Limit
+	// Algorithm of the policy, if omit, it will use Options.Algorithms or Options.Algorithm.
+	Algorithm Algorithm
+	// Burst is the bucket capacity of TokenBucket and GCRA, if omit, it will use Options.Burst.
+	Burst int
+	// Cost is the count a request takes, default is 1, Options.Cost overrides it by request.
+	// Default algorithm only supports 1, and Options.Cost requires other algorithms. With
+	// them, it should not exceed Burst of TokenBucket and GCRA, or the max count of any limit
+	// or tier.
+	Cost int
+	// Key decides how the limiter key is built, default is KeyByRoute.
+	Key KeyStrategy
+	// Headers decides the rate limit headers, default is HeadersDefault.
+	Headers HeaderMode
+	// Exempt requests matching the policy key from limiting, Limits are not required.
+	Exempt bool
+	// Groups are names of Options.Groups, the policy draws from their shared quotas too,
+	// and a request is rejected if the policy or any group is exhausted.
+	Groups []string
+	// MaxDelay is the longest time a rejected request waits for capacity before it proceeds,
+	// such as for internal clients smoothing bursts. It is rejected at once if the wait would
+	// be longer, default is 0, no waiting. It requires an algorithm other than Default.
+	MaxDelay time.Duration
+	// MaxQueue caps the waiting requests of a limiter key, the others are rejected at once,
+	// default is 100 with MaxDelay.
+	MaxQueue int
+	// CountIf counts a request when the response is done only if it returns true for the status
+	// code, such as for limiting failed logins. Requests are still rejected up front when the
+	// limits are exhausted. Responses of returned errors and panics are counted just after they
+	// are sent, so requests of a client racing them may pass the check. It requires an algorithm
+	// other than Default.
+	CountIf func(status int) bool
+	// RefundIf gives the cost of a request back when the response is done if it returns true,
+	// such as for validation failures, 304 responses or client disconnects. Like CountIf,
+	// responses of returned errors and panics are refunded just after they are sent. It requires
+	// an algorithm other than Default, and a store implementing RefundStore.
+	RefundIf func(ctx *gear.Context) bool
+
+	pairs []int              // Limits in the form of ratelimiter-go
+	tiers map[string]*Policy // compiled policies of Tiers
+}
+
+// ConvertPolicy converts the old map form of Options.Policy, such as
+// {"GET /a": []int{3, 5 * 1000, 10, 60 * 1000}}, to policies.
+func ConvertPolicy(m map[string][]int) (map[string]*Policy, error) {
+	policies := make(map[string]*Policy, len(m))
+	for key, p := range m {
+		if len(p)%2 != 0 {
+			return nil, fmt.Errorf("ratelimiter: policy %q, should be pairs of max count and milliseconds, got %v", key, p)
+		}
+		limits := make([]Limit, len(p)/2)
+		for i := range limits {
+			limits[i] = Limit{Max: p[2*i], Window: time.Duration(p[2*i+1]) * time.Millisecond}
+		}
+		policies[key] = &Policy{Limits: limits}
+	}
+	return policies, nil
+}
+
+func validateLimits(limits []Limit) error {
+	if len(limits) == 0 {
+		return fmt.Errorf("no limits")
+	}
+	for i, limit := range limits {
+		if limit.Max <= 0 {
+			return fmt.Errorf("limit %d, max count should be positive, got %d", i, limit.Max)
+		}
+		if limit.Window < time.Millisecond {
+			return fmt.Errorf("limit %d, window should be at least 1ms, got %s", i, limit.Window)
+		}
+	}
+	return nil
+}
+
+// validateWindows checks that limits have distinct windows, the store keys of limits are
+// named by their windows, so two limits of one window would share a counter.
+func validateWindows(limits []Limit) error {
+	for i := range limits {
+		for j := 0; j < i; j++ {
+			if limits[i].Window == limits[j].Window {
+				return fmt.Errorf("limit %d, window %s is already used by limit %d", i, limits[i].Window, j)
+			}
+		}
+	}
+	return nil
+}
+
+// capacity returns the largest cost a request can take from limits, the Burst of TokenBucket and
+// GCRA if set, or the smallest max count, a request costing more would never be allowed.
+func (p *Policy) capacity(limits []Limit) int {
+	if p.Burst > 0 && (p.Algorithm == TokenBucket || p.Algorithm == GCRA) {
+		return p.Burst
+	}
+	c := limits[0].Max
+	for _, limit := range limits[1:] {
+		if limit.Max < c {
+			c = limit.Max
+		}
+	}
+	return c
+}
+
+func (p *Policy) validate() error {
+	if p.Exempt {
+		return nil
+	}
+	if err := validateLimits(p.Limits); err != nil {
+		return err
+	}
+	for _, tier := range sortedKeys(p.Tiers) {
+		if tier == "" {
+			return fmt.Errorf("tier name should not be empty")
+		}
+		if err := validateLimits(p.Tiers[tier]); err != nil {
+			return fmt.Errorf("tier %q, %v", tier, err)
+		}
+	}
+	switch p.Algorithm {
+	case Default:
+		if p.Cost > 1 {
+			return fmt.Errorf("cost should be 1 with Default algorithm, got %d", p.Cost)
+		}
+	case FixedWindow, SlidingWindow, SlidingLog, TokenBucket, GCRA:
+	default:
+		return fmt.Errorf("unknown algorithm %q", p.Algorithm)
+	}
+	if p.Burst < 0 {
+		return fmt.Errorf("burst should not be negative, got %d", p.Burst)
+	}
+	if p.Cost < 0 {
+		return fmt.Errorf("cost should not be negative, got %d", p.Cost)
+	}
+	if p.Algorithm != Default {
+		if err := validateWindows(p.Limits); err != nil {
+			return err
+		}
+		for _, tier := range sortedKeys(p.Tiers) {
+			if err := validateWindows(p.Tiers[tier]); err != nil {
+				return fmt.Errorf("tier %q, %v", tier, err)
+			}
+		}
+	}
+	if c := p.capacity(p.Limits); p.Cost > c {
+		return fmt.Errorf("cost should not exceed the capacity %d, got %d", c, p.Cost)
+	}
+	for _, tier := range sortedKeys(p.Tiers) {
+		if c := p.capacity(p.Tiers[tier]); p.Cost > c {
+			return fmt.Errorf("tier %q, cost should not exceed the capacity %d, got %d", tier, c, p.Cost)
+		}
+	}
+	if p.MaxDelay < 0 {
+		return fmt.Errorf("max delay should not be negative, got %v", p.MaxDelay)
+	}
+	if p.MaxQueue < 0 {
+		return fmt.Errorf("max queue should not be negative, got %d", p.MaxQueue)
+	}
+	if p.MaxDelay > 0 && p.Algorithm == Default {
+		return fmt.Errorf("MaxDelay requires an algorithm other than Default")
+	}
+	if p.CountIf != nil && p.Algorithm == Default {
+		return fmt.Errorf("CountIf requires an algorithm other than Default")
+	}
+	if p.RefundIf != nil {
+		if p.Algorithm == Default {
+			return fmt.Errorf("RefundIf requires an algorithm other than Default")
+		}
+		if p.CountIf != nil {
+			return fmt.Errorf("RefundIf should be omitted with CountIf")
+		}
+	}
+	if p.Key != KeyByRoute && p.Key != KeyByPath {
+		return fmt.Errorf("unknown key strategy %d", p.Key)
+	}
+	if p.Headers < HeadersDefault || p.Headers > HeadersBoth {
+		return fmt.Errorf("unknown header mode %d", p.Headers)
+	}
+	return nil
+}
+
+// compile returns a copy of the policy with the defaults of opts.
+func (p *Policy) compile(key string, opts *Options) (*Policy, error) {
+	name := fmt.Sprintf("policy %q", key)
+	if key == "" {
+		name = "default policy"
+	}
+	alg, ok := opts.Algorithms[key]
+	if !ok {
+		alg = opts.Algorithm
+	}
+	return p.compileAs(name, alg, opts)
+}
+
+// compileGroup returns a copy of the policy of a group with the defaults of opts.
+func (p *Policy) compileGroup(group string, opts *Options) (*Policy, error) {
+	name := fmt.Sprintf("group %q", group)
+	if len(p.Groups) > 0 {
+		return nil, fmt.Errorf("%s, Groups should be omitted", name)
+	}
+	if p.Exempt {
+		return nil, fmt.Errorf("%s, Exempt should be omitted", name)
+	}
+	return p.compileAs(name, opts.Algorithm, opts)
+}
+
+func (p *Policy) compileAs(name string, alg Algorithm, opts *Options) (*Policy, error) {
+	c := *p
+	c.Limits = append([]Limit(nil), p.Limits...)
+	if c.Algorithm == Default {
+		c.Algorithm = alg
+	}
+	if c.Burst == 0 {
+		c.Burst = opts.Burst
+	}
+	if c.Cost == 0 {
+		c.Cost = 1
+	}
+	if c.Headers == HeadersDefault {
+		c.Headers = opts.Headers
+	}
+	if c.MaxDelay > 0 && c.MaxQueue == 0 {
+		c.MaxQueue = 100
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s, %v", name, err)
+	}
+	c.pairs = toPairs(c.Limits)
+	if len(c.Tiers) > 0 {
+		c.tiers = make(map[string]*Policy, len(c.Tiers))
+		for tier, limits := range c.Tiers {
+			t := c
+			t.Limits = append([]Limit(nil), limits...)
+			t.Tiers, t.tiers = nil, nil
+			t.pairs = toPairs(t.Limits)
+			c.tiers[tier] = &t
+		}
+	}
+	return &c, nil
+}
+
+// tier returns the compiled policy of a tier, or p itself if the tier is not listed.
+func (p *Policy) tier(name string) *Policy {
+	if t, ok := p.tiers[name]; ok {
+		return t
+	}
+	return p
+}
+
+func toPairs(limits []Limit) []int {
+	pairs := make([]int, 0, 2*len(limits))
+	for _, limit := range limits {
+		pairs = append(pairs, limit.Max, int(limit.Window/time.Millisecond))
+	}
+	return pairs
+}
+
+// scale returns a copy of the compiled policy with counts divided by n, at least 1.
+func (p *Policy) scale(n int) *Policy {
+	if n <= 1 {
+		return p
+	}
+	div := func(v int) int {
+		if v /= n; v < 1 {
+			return 1
+		}
+		return v
+	}
+	c := *p
+	c.Limits = make([]Limit, len(p.Limits))
+	c.pairs = make([]int, len(p.pairs))
+	for i, limit := range p.Limits {
+		c.Limits[i] = Limit{Max: div(limit.Max), Window: limit.Window}
+		c.pairs[2*i], c.pairs[2*i+1] = c.Limits[i].Max, p.pairs[2*i+1]
+	}
+	if c.Burst > 0 {
+		c.Burst = div(c.Burst)
+	}
+	return &c
+}
@@ -0,0 +1,100 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+)
+
+func TestPolicy(t *testing.T) {
+	t.Run("ConvertPolicy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		policies, err := ConvertPolicy(map[string][]int{
+			"GET /a": []int{3, 5 * 1000, 10, 60 * 1000},
+		})
+		assert.Nil(err)
+		assert.Equal([]Limit{{3, 5 * time.Second}, {10, time.Minute}}, policies["GET /a"].Limits)
+
+		_, err = ConvertPolicy(map[string][]int{"/b": []int{3, 5 * 1000, 10}})
+		assert.Equal(`ratelimiter: policy "/b", should be pairs of max count and milliseconds, got [3 5000 10]`, err.Error())
+	})
+
+	t.Run("compile should set defaults", func(t *testing.T) {
+		assert := assert.New(t)
+		opts := &Options{
+			Algorithm:  TokenBucket,
+			Algorithms: map[string]Algorithm{"/b": GCRA},
+			Burst:      5,
+		}
+		p, err := (&Policy{Limits: []Limit{{3, time.Second}, {10, 1500 * time.Millisecond}}}).compile("/a", opts)
+		assert.Nil(err)
+		assert.Equal(TokenBucket, p.Algorithm)
+		assert.Equal(5, p.Burst)
+		assert.Equal(1, p.Cost)
+		assert.Equal([]int{3, 1000, 10, 1500}, p.pairs)
+		assert.Equal(0, p.MaxQueue)
+
+		p, err = (&Policy{Limits: []Limit{{3, time.Second}}, MaxDelay: time.Second}).compile("/a", opts)
+		assert.Nil(err)
+		assert.Equal(100, p.MaxQueue)
+
+		// Burst is the capacity of TokenBucket and GCRA
+		p, err = (&Policy{Limits: []Limit{{3, time.Second}}, Burst: 5, Cost: 4}).compile("/a", opts)
+		assert.Nil(err)
+
+		p, err = (&Policy{Limits: []Limit{{3, time.Second}}}).compile("/b", opts)
+		assert.Equal(GCRA, p.Algorithm)
+
+		p, err = (&Policy{
+			Limits: []Limit{{3, time.Second}},
+			Tiers:  map[string][]Limit{"pro": {{30, time.Second}}},
+		}).compile("/b", opts)
+		assert.Nil(err)
+		assert.Equal([]int{30, 1000}, p.tier("pro").pairs)
+		assert.Equal(GCRA, p.tier("pro").Algorithm)
+		assert.Equal(p, p.tier("free"))
+
+		s := p.scale(2)
+		assert.Equal(1, s.Limits[0].Max)
+		assert.Equal(2, s.Burst)
+		assert.Equal([]int{1, 1000}, s.pairs)
+		assert.Equal(3, p.Limits[0].Max)
+	})
+
+	t.Run("compile should validate", func(t *testing.T) {
+		assert := assert.New(t)
+		cases := map[string]*Policy{
+			`policy "/a", no limits`:                                                &Policy{},
+			`policy "/a", limit 1, max count should be positive, got 0`:             &Policy{Limits: []Limit{{1, time.Second}, {0, time.Second}}},
+			`policy "/a", limit 0, window should be at least 1ms, got 0s`:           &Policy{Limits: []Limit{{1, 0}}},
+			`policy "/a", unknown algorithm "leaky"`:                                &Policy{Limits: []Limit{{1, time.Second}}, Algorithm: "leaky"},
+			`policy "/a", cost should be 1 with Default algorithm, got 2`:           &Policy{Limits: []Limit{{1, time.Second}}, Cost: 2},
+			`policy "/a", burst should not be negative, got -1`:                     &Policy{Limits: []Limit{{1, time.Second}}, Burst: -1},
+			`policy "/a", tier "pro", limit 0, max count should be positive, got 0`: &Policy{Limits: []Limit{{1, time.Second}}, Tiers: map[string][]Limit{"pro": {{0, time.Second}}}},
+			`policy "/a", tier name should not be empty`:                            &Policy{Limits: []Limit{{1, time.Second}}, Tiers: map[string][]Limit{"": {{1, time.Second}}}},
+			`policy "/a", unknown key strategy 5`:                                   &Policy{Limits: []Limit{{1, time.Second}}, Key: 5},
+			`policy "/a", max delay should not be negative, got -1s`:                &Policy{Limits: []Limit{{1, time.Second}}, MaxDelay: -time.Second},
+			`policy "/a", max queue should not be negative, got -1`:                 &Policy{Limits: []Limit{{1, time.Second}}, MaxQueue: -1},
+			`policy "/a", limit 1, window 1s is already used by limit 0`:            &Policy{Limits: []Limit{{10, time.Second}, {5, time.Second}}, Algorithm: FixedWindow},
+			`policy "/a", tier "pro", limit 1, window 1m0s is already used by limit 0`: &Policy{Limits: []Limit{{10, time.Second}}, Algorithm: GCRA,
+				Tiers: map[string][]Limit{"pro": {{10, time.Minute}, {20, time.Minute}}}},
+			`policy "/a", MaxDelay requires an algorithm other than Default`: &Policy{Limits: []Limit{{1, time.Second}}, MaxDelay: time.Second},
+			`policy "/a", cost should not exceed the capacity 2, got 3`:      &Policy{Limits: []Limit{{5, time.Second}, {2, time.Minute}}, Algorithm: FixedWindow, Cost: 3},
+			`policy "/a", cost should not exceed the capacity 2, got 4`:      &Policy{Limits: []Limit{{5, time.Second}}, Algorithm: GCRA, Burst: 2, Cost: 4},
+			`policy "/a", tier "pro", cost should not exceed the capacity 3, got 4`: &Policy{Limits: []Limit{{5, time.Second}}, Algorithm: SlidingLog, Cost: 4,
+				Tiers: map[string][]Limit{"pro": {{3, time.Second}}}},
+			`policy "/a", CountIf requires an algorithm other than Default`:  &Policy{Limits: []Limit{{1, time.Second}}, CountIf: func(int) bool { return true }},
+			`policy "/a", RefundIf requires an algorithm other than Default`: &Policy{Limits: []Limit{{1, time.Second}}, RefundIf: func(*gear.Context) bool { return true }},
+			`policy "/a", RefundIf should be omitted with CountIf`: &Policy{Limits: []Limit{{1, time.Second}}, Algorithm: GCRA,
+				CountIf: func(int) bool { return true }, RefundIf: func(*gear.Context) bool { return true }},
+		}
+		for msg, p := range cases {
+			_, err := p.compile("/a", &Options{})
+			if assert.NotNil(err, msg) {
+				assert.Equal(msg, err.Error())
+			}
+		}
+	})
+}
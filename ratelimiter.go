@@ -1,7 +1,12 @@
 package ratelimiter
 
 import (
+	"log"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teambition/gear"
@@ -9,86 +14,682 @@ import (
 )
 
 // Version is ratelimiter's version
-const Version = "1.0.1"
+const Version = "1.1.0"
+
+// FailMode decides how requests are handled when the limiter backend returns an error.
+type FailMode int
+
+const (
+	// FailOpen lets requests pass without limiting, it is the default.
+	FailOpen FailMode = iota
+	// FailClosed rejects requests with 503 Service Unavailable.
+	FailClosed
+	// FailLocal switches to a local memory limiter when the redis backend fails,
+	// and switches back after a health probe succeeds.
+	FailLocal
+)
+
+// probeKey is the limiter id used to probe the redis backend in FailLocal mode.
+const probeKey = "ratelimiter:probe"
 
 // Options for Limiter
 type Options struct {
 	// Key prefix, default is "LIMIT:".
 	Prefix string
-	// The max count in duration for no policy, default is 100.
+	// The max count in duration for requests matching no policy, default is 100.
 	Max int
-	// Count duration for no policy, default is 1 Minute.
+	// Count duration for requests matching no policy, default is 1 Minute.
 	Duration time.Duration
-	// Policy is a map of custom limiter policy.
+	// DefaultPolicy is the policy for requests matching no policy key, such as []int{10, 1000, 100, 60 * 1000}.
+	// If omit, it will use Max and Duration. All unmatched requests of a client share one limiter key.
+	DefaultPolicy []int
+	// IgnoreUnmatched skips requests matching no policy key, so only listed routes are limited,
+	// it is the behaviour before version 1.1.0.
+	IgnoreUnmatched bool
+	// Policy is a map of custom limiter policy. A key is "METHOD /path", "/path" or "METHOD",
+	// and the path can be a pattern in gear router style: "/users/:id", "/users/:id(^\d+$)",
+	// "/files/*" or "/files/:path*". When several keys match, the most specific one wins: segments
+	// are compared from left to right (static > regexp > param > wildcard), then a key with method
+	// beats the same path without one, and method-only keys come last.
 	Policy map[string][]int
-	// GetID returns limiter id for a request.
+	// Policies is a map of typed limiter policy, keys are the same as Policy. Use the key "/*"
+	// for a typed policy of all unmatched paths. ConvertPolicy converts Policy to Policies.
+	Policies map[string]*Policy
+	// GetID returns limiter id for a request, requests with an empty id are not limited.
+	// If omit, it will use ByIPNet(IPv6Prefix, TrustedProxies...), the client IP. See ByHeader,
+	// ByCookie, ByQuery, ByJWTClaim and FirstOf for other ready-made GetID functions.
 	GetID func(ctx *gear.Context) string
+	// Resolve returns the policy of a request, such as limits of a tenant from a database.
+	// It is called before the static policies: if ok is false, the policy of Policy or Policies
+	// is used, if the policy is nil, the request is not limited. Results are cached by the id
+	// and the matched policy key for ResolveTTL. A wrong policy is reported to OnError,
+	// and the static policy is used until the result expires.
+	Resolve func(ctx *gear.Context) (p *Policy, ok bool)
+	// ResolveTTL is how long the results of Resolve are cached, default is 1 minute.
+	ResolveTTL time.Duration
+	// Cost returns the cost of a request, such as the number of items in a batch, it overrides
+	// Policy.Cost when positive. Remaining counts are decremented by the cost, and the request
+	// is rejected when the cost exceeds what remains. Default algorithm only supports cost 1,
+	// so Cost requires an algorithm other than Default for the default policy and all policies.
+	Cost func(ctx *gear.Context) int
+	// GetTier returns the customer tier of a request, such as "free" or "pro", for Policy.Tiers.
+	// The tier is part of the limiter key, and it is set in the X-Ratelimit-Tier header.
+	GetTier func(ctx *gear.Context) string
+	// DefaultTier is the tier when GetTier is omitted or returns "".
+	DefaultTier string
+	// TrustedProxies are the IPs or CIDRs of load balancers and proxies, such as "10.0.0.0/8",
+	// used by the default GetID. Forwarded headers are only read from them, and the forwarded chain
+	// is walked from the right to the first untrusted address, so clients can't spoof their IP.
+	TrustedProxies []string
+	// IPv6Prefix aggregates IPv6 clients by their network for the default GetID, such as 64
+	// limits per /64. If omit, every IPv6 address is limited alone.
+	IPv6Prefix int
 	// Use a redis client for limiter, if omit, it will use a memory limiter.
+	// The clients of github.com/teambition/gear-ratelimiter/redis also implement Store for other algorithms.
 	Client baselimiter.RedisClient
+	// Groups are named policies of shared quotas, such as {"heavy": {Limits: []Limit{{100, time.Hour}}}},
+	// a policy draws from them by Policy.Groups. All requests of a client in a group share one limiter key.
+	// Groups and the policies drawing from them require an algorithm other than Default.
+	Groups map[string]*Policy
+	// Scopes are extra identities a request is limited by in one check, such as the organization
+	// of a user and a service-wide ceiling. A request takes quota only if its policy, groups and all
+	// scopes allow it. Scopes and all policies require an algorithm other than Default.
+	Scopes []Scope
+	// Algorithm is the limiting algorithm of all policies, default is Default, the algorithm of
+	// github.com/teambition/ratelimiter-go. Other algorithms are run by a memory Store if Client is omitted,
+	// or by the Client, which should implement Store. All limits of a request are taken atomically
+	// if the store implements BatchStore, otherwise they are taken in turn, and a request rejected
+	// by a later limit keeps the earlier ones taken.
+	Algorithm Algorithm
+	// Algorithms sets the limiting algorithm for some policy keys, such as {"POST /import": TokenBucket}.
+	Algorithms map[string]Algorithm
+	// Burst is the bucket capacity of TokenBucket and GCRA, default is the max count of each limit.
+	Burst int
+	// Headers is the header mode of policies with HeadersDefault, such as HeadersIETF for the
+	// headers of the IETF draft, default is HeadersDefault, the X-Ratelimit headers.
+	Headers HeaderMode
+	// FailMode decides how requests are handled when the limiter backend fails, default is FailOpen.
+	FailMode FailMode
+	// OnError is called with the backend error before FailMode applies, use it for logging and metrics.
+	// If it returns a non-nil error, Serve returns that error and FailMode is skipped.
+	// If omit, the error will be written by the standard logger.
+	OnError func(ctx *gear.Context, err error) error
+	// Instances is the number of service instances sharing the redis backend, default is 1.
+	// In FailLocal mode, local limits are divided by it, so that all instances together
+	// keep close to the shared limits.
+	Instances int
+	// ProbeInterval is how often the failed redis backend is probed in FailLocal mode, default is 5 seconds.
+	ProbeInterval time.Duration
+	// OnFallback is called when the limiter switches to the local memory limiter (local is true
+	// and err is the backend error) and when it switches back to redis (local is false).
+	OnFallback func(local bool, err error)
+	// OnLimited renders the response of a limited request, such as the error envelope of an API
+	// by ctx.JSON, instead of 429 with "Rate limit exceeded, retry in N seconds.". The rate limit
+	// headers are set before it is called. Its error is returned by Serve, and if it returns nil
+	// without writing the response, the default 429 error is returned.
+	OnLimited func(ctx *gear.Context, res *Result) error
+	// SetHeaders sets the rate limit headers of a request instead of the header mode of the policy,
+	// such as for custom header names. It is not called for policies with HeadersNone.
+	SetHeaders func(ctx *gear.Context, res *Result)
+}
+
+// Result is the limiting result of a request.
+type Result struct {
+	// PolicyKey is the matched policy key, such as "GET /users/:id", "" for the default policy.
+	PolicyKey string
+	// ID is the identifier of the client by Options.GetID.
+	ID string
+	// Key is the limiter key of the check the usage belongs to.
+	Key string
+	// Policy is the compiled policy of the check, Policy.Limits are its windows.
+	Policy *Policy
+	// Tier is the customer tier of the request, "" if there is none.
+	Tier string
+	// Group is the name of the group of the check, "" if it isn't a group.
+	Group string
+	// Scope is the name of the scope of the check, "" if it isn't a scope.
+	Scope string
+	// Cost is the count the request takes.
+	Cost int
+	// Usage of the check, the most exhausted one of the request.
+	Usage
+}
+
+type resultKey struct{}
+
+// FromContext returns the limiting result of a request served by RateLimiter, so handlers can
+// degrade their responses when the remaining quota is low. It is false if the request is not
+// limited, such as exempt requests or requests without identifier.
+func FromContext(ctx *gear.Context) (*Result, bool) {
+	val, err := ctx.Any(resultKey{})
+	if err != nil {
+		return nil, false
+	}
+	res, ok := val.(*Result)
+	return res, ok
 }
 
 //RateLimiter ...
 type RateLimiter struct {
-	options *Options
-	limiter *baselimiter.Limiter
+	options       *Options
+	getID         func(ctx *gear.Context) string
+	prefix        string
+	set           atomic.Value // *policySet, swapped by UpdatePolicies
+	defaultPolicy *Policy
+	limiter       *baselimiter.Limiter
+	store         Store
+	local         *baselimiter.Limiter // memory limiter for FailLocal
+	localStore    Store                // memory store for FailLocal
+	// fallback is 1 when requests are counted by the local limiter.
+	fallback int32
+	resolved *resolveCache      // results of Options.Resolve
+	groups   map[string]*Policy // compiled policies of Options.Groups
+	scopes   []Scope            // Options.Scopes with compiled policies
+	queueMu  sync.Mutex
+	queues   map[string]int // waiting requests by limiter key
+	closed   chan struct{}  // closed by Close to stop the probe
+	closer   sync.Once
 }
 
-func (l *RateLimiter) getArgs(ctx *gear.Context) (key string, p []int) {
-	id := l.options.GetID(ctx)
+// limitArgs are the limiter arguments of a request.
+type limitArgs struct {
+	key    string
+	id     string // identifier of the client
+	route  string // matched policy key
+	policy *Policy
+	tier   string
+	cost   int
+	group  string       // name of the group, "" for the client
+	scope  string       // name of the scope, "" for the client
+	checks []*limitArgs // groups and scopes of the request
+}
+
+// getArgs returns the limiter arguments of a request, nil if the request is not limited.
+func (l *RateLimiter) getArgs(ctx *gear.Context) (*limitArgs, error) {
+	id := l.getID(ctx)
 	if id == "" {
-		return
+		return nil, nil
 	}
-	key = ctx.Method + " " + ctx.Path
-	var ok bool
-	p, ok = l.options.Policy[key]
-	if !ok {
-		key = ctx.Path
-		if p, ok = l.options.Policy[key]; !ok {
-			key = ctx.Method
-			if p, ok = l.options.Policy[key]; !ok {
-				p = []int{} // It will use Options.Max and Options.Duration if no policy
+	a := &limitArgs{id: id}
+	// All requests matching the same pattern share one limiter key.
+	set := l.set.Load().(*policySet)
+	r := set.matcher.match(ctx.Method, ctx.Path)
+	if r != nil {
+		a.key, a.route, a.policy = r.key, r.key, set.policies[r.key]
+	}
+	if l.options.Resolve != nil {
+		p, ok, err := l.resolve(ctx, id, a.key)
+		if err != nil {
+			// a wrong resolved policy falls back to the static policy
+			if err = reportError(ctx, l.options.OnError, err); err != nil {
+				return nil, err
+			}
+		} else if ok {
+			if p == nil {
+				return nil, nil
+			}
+			a.policy = p
+		}
+	}
+	if a.policy == nil {
+		if l.options.IgnoreUnmatched {
+			return nil, nil
+		}
+		a.policy = l.defaultPolicy
+	}
+	if a.policy.Exempt {
+		return nil, nil
+	}
+	if a.policy.Key == KeyByPath {
+		a.key = ctx.Method + " " + ctx.Path
+	}
+	a.key = id + a.key
+	for _, name := range a.policy.Groups {
+		// All requests of a client in a group share one limiter key.
+		a.checks = append(a.checks, &limitArgs{key: id + "#" + name, policy: l.groups[name], group: name})
+	}
+	for _, s := range l.scopes {
+		if sid := s.GetID(ctx); sid != "" {
+			a.checks = append(a.checks, &limitArgs{key: "scope:" + s.Name + ":" + sid, policy: s.Policy, scope: s.Name})
+		}
+	}
+	if l.options.GetTier != nil {
+		a.tier = l.options.GetTier(ctx)
+	}
+	if a.tier == "" {
+		a.tier = l.options.DefaultTier
+	}
+	if a.tier != "" {
+		// Counts start again when a client changes its tier. Scopes are shared by clients
+		// of all tiers, so they are not tiered.
+		a.key, a.policy = a.key+"@"+a.tier, a.policy.tier(a.tier)
+		for _, c := range a.checks {
+			if c.scope == "" {
+				c.key, c.policy = c.key+"@"+a.tier, c.policy.tier(a.tier)
 			}
 		}
 	}
-	key = id + key
-	return
+	a.cost = a.policy.Cost
+	if l.options.Cost != nil {
+		if cost := l.options.Cost(ctx); cost > 0 {
+			a.cost = cost
+		}
+	}
+	return a, nil
 }
 
 //Serve ...
 func (l *RateLimiter) Serve(ctx *gear.Context) error {
-	key, p := l.getArgs(ctx)
-	if key == "" {
-		return nil
+	a, err := l.getArgs(ctx)
+	if a == nil {
+		return err
 	}
-	if len(p) < 1 {
-		return nil
+	p := a.policy
+	take := l.get
+	if p.CountIf != nil {
+		take = l.check
 	}
-	res, err := l.limiter.Get(key, p...)
-	if err != nil {
-		return nil
-	}
-	ctx.Set("X-Ratelimit-Limit", strconv.Itoa(res.Total))
-	ctx.Set("X-Ratelimit-Remaining", strconv.Itoa(res.Remaining))
-	ctx.Set("X-Ratelimit-Reset", strconv.Itoa(int(res.Reset.Unix())))
-	if res.Remaining < 0 {
-		after := int(res.Reset.Sub(time.Now()).Seconds())
-		ctx.Set("Retry-After", strconv.Itoa(after))
+	res, by, err := take(ctx, a)
+	if res == nil {
+		return err
+	}
+	if !res.Allowed && p.MaxDelay > 0 {
+		if res, by, err = l.wait(ctx, a, res, by, take); res == nil {
+			return err
+		}
+	}
+	// round up, a sub-second wait of TokenBucket and GCRA is not "retry in 0 seconds".
+	after := int(math.Ceil(res.RetryAfter.Seconds()))
+	result := &Result{PolicyKey: a.route, ID: a.id, Key: by.key, Policy: by.policy, Tier: a.tier,
+		Group: by.group, Scope: by.scope, Cost: a.cost, Usage: *res}
+	ctx.SetAny(resultKey{}, result)
+	if p.Headers != HeadersNone && l.options.SetHeaders != nil {
+		l.options.SetHeaders(ctx, result)
+	} else if p.Headers != HeadersNone {
+		if p.Headers != HeadersIETF {
+			ctx.Set("X-Ratelimit-Limit", strconv.Itoa(res.Total))
+			ctx.Set("X-Ratelimit-Remaining", strconv.Itoa(res.Remaining))
+			ctx.Set("X-Ratelimit-Reset", strconv.Itoa(int(res.Reset.Unix())))
+		}
+		if p.Headers == HeadersIETF || p.Headers == HeadersBoth {
+			setIETFHeaders(ctx, res, by.policy)
+		}
+		if a.tier != "" {
+			ctx.Set("X-Ratelimit-Tier", a.tier)
+		}
+		if by.scope != "" {
+			ctx.Set("X-Ratelimit-Scope", by.scope)
+		}
+		if !res.Allowed {
+			ctx.Set("Retry-After", strconv.Itoa(after))
+		}
+	}
+	if !res.Allowed {
+		if l.options.OnLimited != nil {
+			if err = l.options.OnLimited(ctx, result); err != nil || ctx.Res.HeaderWrote() {
+				return err
+			}
+		}
 		return gear.ErrTooManyRequests.WithMsgf("Rate limit exceeded, retry in %d seconds.", after)
 	}
+	if p.CountIf != nil {
+		onDone(ctx, func() {
+			if p.CountIf(ctx.Res.Status()) {
+				l.get(ctx, a)
+			}
+		})
+	} else if p.RefundIf != nil {
+		onDone(ctx, func() {
+			if p.RefundIf(ctx) {
+				l.refund(ctx, a)
+			}
+		})
+	}
 	return nil
 }
 
-//New ...
-func New(opts *Options) (l *RateLimiter) {
-	if opts.GetID == nil {
-		panic("getId function required")
+// onDone runs fn once when the response is done: by an after hook before the header is sent,
+// so the next request of the client sees its effect. ctx.Error drops after hooks when a handler
+// panics or returns an error, fn is run by an end hook then, in a goroutine after the response.
+func onDone(ctx *gear.Context, fn func()) {
+	var once sync.Once
+	hook := func() { once.Do(fn) }
+	ctx.After(hook)
+	ctx.OnEnd(hook)
+}
+
+// setIETFHeaders sets the headers of the IETF draft, p is the policy of the usage.
+func setIETFHeaders(ctx *gear.Context, res *Usage, p *Policy) {
+	remaining := res.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	reset := int(math.Ceil(time.Until(res.Reset).Seconds()))
+	if reset < 0 {
+		reset = 0
+	}
+	ctx.Set("RateLimit-Limit", strconv.Itoa(res.Total))
+	ctx.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	ctx.Set("RateLimit-Reset", strconv.Itoa(reset))
+	policies := make([]string, len(p.Limits))
+	for i, limit := range p.Limits {
+		policies[i] = strconv.Itoa(limit.Max) + ";w=" + strconv.Itoa(int(math.Ceil(limit.Window.Seconds())))
+	}
+	ctx.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// wait waits for capacity while the retry time is within MaxDelay of the policy and the queue
+// of the limiter key isn't full, it takes the request again by take and returns the last result.
+func (l *RateLimiter) wait(ctx *gear.Context, a *limitArgs, res *Usage, by *limitArgs,
+	take func(*gear.Context, *limitArgs) (*Usage, *limitArgs, error)) (*Usage, *limitArgs, error) {
+	p := a.policy
+	deadline := time.Now().Add(p.MaxDelay)
+	if res.RetryAfter > p.MaxDelay {
+		return res, by, nil
+	}
+	l.queueMu.Lock()
+	if l.queues[a.key] >= p.MaxQueue {
+		l.queueMu.Unlock()
+		return res, by, nil
+	}
+	l.queues[a.key]++
+	l.queueMu.Unlock()
+	defer func() {
+		l.queueMu.Lock()
+		if l.queues[a.key]--; l.queues[a.key] == 0 {
+			delete(l.queues, a.key)
+		}
+		l.queueMu.Unlock()
+	}()
+
+	for !res.Allowed && res.RetryAfter <= time.Until(deadline) {
+		delay := res.RetryAfter
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+		var err error
+		if res, by, err = take(ctx, a); res == nil {
+			return nil, nil, err
+		}
+	}
+	return res, by, nil
+}
+
+// check checks the request without counting it, for policies with CountIf. It is rejected
+// if less than its cost remains.
+func (l *RateLimiter) check(ctx *gear.Context, a *limitArgs) (*Usage, *limitArgs, error) {
+	peek := *a
+	peek.cost = 0
+	res, by, err := l.get(ctx, &peek)
+	if res != nil && res.Remaining < a.cost {
+		u := *res
+		u.Allowed = false
+		if u.RetryAfter = time.Until(u.Reset); u.RetryAfter < 0 {
+			u.RetryAfter = 0
+		}
+		res = &u
+	}
+	return res, by, err
+}
+
+// get counts the request, it returns the most exhausted usage and the check of it.
+func (l *RateLimiter) get(ctx *gear.Context, a *limitArgs) (*Usage, *limitArgs, error) {
+	if l.local != nil && atomic.LoadInt32(&l.fallback) == 1 {
+		res, by := l.getLocal(a)
+		return res, by, nil
+	}
+	res, by, err := l.takeAll(l.limiter, l.store, a, 1)
+	if err == nil {
+		return res, by, nil
 	}
 
-	limiter := baselimiter.New(baselimiter.Options{
+	if err = reportError(ctx, l.options.OnError, err); err != nil {
+		return nil, nil, err
+	}
+	switch l.options.FailMode {
+	case FailClosed:
+		return nil, nil, gear.ErrServiceUnavailable.WithMsg("Rate limiter is unavailable.")
+	case FailLocal:
+		if l.local != nil {
+			l.switchLocal(err)
+			res, by := l.getLocal(a)
+			return res, by, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// reportError calls onError with err, or writes it by the standard logger if onError is nil.
+// It serves the OnError option of every limiter.
+func reportError(ctx *gear.Context, onError func(ctx *gear.Context, err error) error, err error) error {
+	if onError != nil {
+		return onError(ctx, err)
+	}
+	log.Printf("ratelimiter: %s %s, %v", ctx.Method, ctx.Path, err)
+	return nil
+}
+
+// takeAll counts the request with its policy, groups and scopes, policy counts are divided by n.
+// It returns the most exhausted usage and its check. A policy of Default algorithm is run by the
+// limiter, it has no groups or scopes. The limits of other checks are taken by the store together,
+// in one TakeAll if it is a BatchStore.
+func (l *RateLimiter) takeAll(limiter *baselimiter.Limiter, store Store, a *limitArgs, n int) (*Usage, *limitArgs, error) {
+	var res *Usage
+	var by *limitArgs
+	var reqs []Request
+	var owners []*limitArgs
+	for _, c := range append([]*limitArgs{a}, a.checks...) {
+		p := c.policy.scale(n)
+		if p.Algorithm != Default {
+			for _, req := range l.storeRequests(c, p, a.cost) {
+				reqs = append(reqs, req)
+				owners = append(owners, c)
+			}
+			continue
+		}
+		if a.cost == 0 {
+			// the limiter can't check without counting, checks of Default algorithm are
+			// counted after the response only.
+			continue
+		}
+		r, err := limiter.Get(c.key, p.pairs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		u := &Usage{Allowed: r.Remaining >= 0, Total: r.Total, Remaining: r.Remaining, Reset: r.Reset}
+		if !u.Allowed {
+			u.RetryAfter = r.Reset.Sub(time.Now())
+		}
+		if mostExhausted(res, u) == u {
+			res, by = u, c
+		}
+		if !u.Allowed {
+			return res, by, nil
+		}
+	}
+
+	us, err := takeRequests(store, reqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range us {
+		if mostExhausted(res, &us[i]) == &us[i] {
+			res, by = &us[i], owners[i]
+		}
+	}
+	return res, by, nil
+}
+
+// storeRequests returns the store requests of the limits of a check with policy p.
+func (l *RateLimiter) storeRequests(c *limitArgs, p *Policy, cost int) []Request {
+	reqs := make([]Request, len(p.Limits))
+	for i, limit := range p.Limits {
+		reqs[i] = Request{
+			Key:       l.prefix + string(p.Algorithm) + ":" + c.key + ":" + strconv.Itoa(p.pairs[2*i+1]),
+			Algorithm: p.Algorithm,
+			Limit:     limit,
+			Burst:     p.Burst,
+			Cost:      cost,
+		}
+	}
+	return reqs
+}
+
+// refund gives the cost of a counted request back to the store, checks of Default algorithm
+// are not refunded.
+func (l *RateLimiter) refund(ctx *gear.Context, a *limitArgs) {
+	store, n := l.store, 1
+	if l.local != nil && atomic.LoadInt32(&l.fallback) == 1 {
+		store, n = l.localStore, l.options.Instances
+	}
+	rs, ok := store.(RefundStore)
+	if !ok {
+		return
+	}
+	var reqs []Request
+	for _, c := range append([]*limitArgs{a}, a.checks...) {
+		if p := c.policy.scale(n); p.Algorithm != Default {
+			reqs = append(reqs, l.storeRequests(c, p, a.cost)...)
+		}
+	}
+	if err := rs.Refund(reqs); err != nil {
+		reportError(ctx, l.options.OnError, err)
+	}
+}
+
+// takeRequests takes reqs by one TakeAll of a BatchStore, or in turn until one is rejected.
+func takeRequests(store Store, reqs []Request) ([]Usage, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+	if bs, ok := store.(BatchStore); ok {
+		return bs.TakeAll(reqs)
+	}
+	us := make([]Usage, 0, len(reqs))
+	for _, req := range reqs {
+		u, err := store.Take(req)
+		if err != nil {
+			return nil, err
+		}
+		if us = append(us, u); !u.Allowed {
+			break
+		}
+	}
+	return us, nil
+}
+
+// mostExhausted returns the rejected usage, or the one with less remaining.
+func mostExhausted(res, u *Usage) *Usage {
+	if res == nil || (res.Allowed && !u.Allowed) || (res.Allowed == u.Allowed && u.Remaining < res.Remaining) {
+		return u
+	}
+	return res
+}
+
+// getLocal counts the request with the local limiter, policy counts are divided by Instances.
+func (l *RateLimiter) getLocal(a *limitArgs) (*Usage, *limitArgs) {
+	res, by, err := l.takeAll(l.local, l.localStore, a, l.options.Instances)
+	if err != nil {
+		return nil, nil
+	}
+	return res, by
+}
+
+// switchLocal switches to the local limiter and probes redis until it recovers.
+func (l *RateLimiter) switchLocal(err error) {
+	if !atomic.CompareAndSwapInt32(&l.fallback, 0, 1) {
+		return
+	}
+	if l.options.OnFallback != nil {
+		l.options.OnFallback(true, err)
+	}
+	go func() {
+		interval := l.options.ProbeInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.closed:
+				return
+			case <-ticker.C:
+			}
+			if _, err := l.limiter.Get(probeKey, 1, 1); err == nil {
+				break
+			}
+		}
+		atomic.StoreInt32(&l.fallback, 0)
+		if l.options.OnFallback != nil {
+			l.options.OnFallback(false, nil)
+		}
+	}()
+}
+
+// Close stops probing the redis backend in FailLocal mode, such as when the service shuts down
+// or the limiter is replaced. A limiter that has switched to the local limiter stays on it.
+func (l *RateLimiter) Close() error {
+	l.closer.Do(func() { close(l.closed) })
+	return nil
+}
+
+//New returns a RateLimiter, it panics with a *ValidationError for wrong Options.
+func New(opts *Options) *RateLimiter {
+	l, err := NewE(opts)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// NewE returns a RateLimiter, or a *ValidationError with all problems of wrong Options.
+func NewE(opts *Options) (*RateLimiter, error) {
+	c, err := opts.compile()
+	if err != nil {
+		return nil, err
+	}
+	l := &RateLimiter{
+		options:       opts,
+		getID:         opts.GetID,
+		prefix:        opts.Prefix,
+		defaultPolicy: c.defaultPolicy,
+		store:         c.store,
+		groups:        c.groups,
+		scopes:        c.scopes,
+		queues:        make(map[string]int),
+		closed:        make(chan struct{}),
+	}
+	l.set.Store(c.set)
+	if l.prefix == "" {
+		l.prefix = "LIMIT:"
+	}
+	if opts.Resolve != nil {
+		l.resolved = newResolveCache(opts.ResolveTTL)
+	}
+	if l.getID == nil {
+		l.getID = ByIPNet(opts.IPv6Prefix, opts.TrustedProxies...)
+	}
+	l.limiter = baselimiter.New(baselimiter.Options{
 		Prefix:   opts.Prefix,
 		Max:      opts.Max,
 		Duration: opts.Duration,
 		Client:   opts.Client,
 	})
-	return &RateLimiter{options: opts, limiter: limiter}
+	if opts.Client != nil && opts.FailMode == FailLocal {
+		l.local = baselimiter.New(baselimiter.Options{
+			Prefix:   opts.Prefix,
+			Max:      opts.Max,
+			Duration: opts.Duration,
+		})
+		l.localStore = NewMemoryStore()
+	}
+	return l, nil
 }
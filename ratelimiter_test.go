@@ -5,9 +5,15 @@ import (
 	"compress/zlib"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -81,6 +87,49 @@ func (resp *GearResponse) Text() (val string, err error) {
 	}
 	return string(b), err
 }
+
+// failClient is a RedisClient that loads scripts but fails to eval them, like a redis in trouble.
+type failClient struct{}
+
+func (c *failClient) RateDel(key string) error {
+	return errors.New("redis: connection refused")
+}
+func (c *failClient) RateEvalSha(sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("redis: connection refused")
+}
+func (c *failClient) RateScriptLoad(script string) (string, error) {
+	return "sha1", nil
+}
+
+// flakyClient is a RedisClient that fails to eval scripts when it is down.
+type flakyClient struct {
+	down int32
+}
+
+func (c *flakyClient) RateDel(key string) error {
+	return nil
+}
+func (c *flakyClient) RateEvalSha(sha1 string, keys []string, args ...interface{}) (interface{}, error) {
+	if atomic.LoadInt32(&c.down) == 1 {
+		return nil, errors.New("redis: connection refused")
+	}
+	reset := time.Now().Add(time.Second).UnixNano() / 1e6
+	return []interface{}{int64(0), int64(1), int64(1000), reset}, nil
+}
+func (c *flakyClient) RateScriptLoad(script string) (string, error) {
+	return "sha1", nil
+}
+
+// takeClient hides TakeAll of a redis client, it takes keys in turn like DefaultClusterClient.
+type takeClient struct {
+	storeClient
+}
+
+type storeClient interface {
+	baselimiter.RedisClient
+	ratelimiter.Store
+}
+
 func genID() string {
 	buf := make([]byte, 12)
 	_, err := rand.Read(buf)
@@ -93,15 +142,1192 @@ func genID() string {
 //--------- End ---------
 
 func TestRateLimiterWithMemory(t *testing.T) {
-	t.Run("RateLimiter with not GetID func should be", func(t *testing.T) {
-		defer func() {
-			if r := recover(); r == nil {
-				t.Errorf("getId function required")
+	t.Run("RateLimiter with not GetID func should limit by IP", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			Policy: map[string][]int{"/ip": []int{1, 1000}},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		url := "http://" + srv.Addr().String() + "/ip"
+		res, err := RequestBy("GET", url)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		// X-Forwarded-For is not trusted without trusted proxies
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		res, err = DefaultClientDo(req)
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+	})
+
+	t.Run("RateLimiter with TrustedProxies should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			TrustedProxies: []string{"127.0.0.0/8", "::1"},
+			Policy:         map[string][]int{"/proxy": []int{1, 1000}},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		url := "http://" + srv.Addr().String() + "/proxy"
+		for i, xff := range []string{"1.2.3.4", "6.6.6.6, 5.6.7.8", "1.2.3.4, 5.6.7.8"} {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Header.Set("X-Forwarded-For", xff)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			if i < 2 {
+				assert.Equal(200, res.StatusCode)
+			} else {
+				assert.Equal(429, res.StatusCode)
+			}
+		}
+
+		err := (&ratelimiter.Options{TrustedProxies: []string{"10.0.0.0/33"}, IPv6Prefix: 129}).Validate()
+		assert.Equal(`ratelimiter: invalid options: TrustedProxies, invalid trusted proxy "10.0.0.0/33"; `+
+			`IPv6Prefix should be between 0 and 128, got 129`, err.Error())
+	})
+
+	t.Run("RateLimiter with GetTier should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID: func(ctx *gear.Context) string {
+				return "user"
+			},
+			GetTier:     ratelimiter.ByHeader("X-Tier"),
+			DefaultTier: "free",
+			Policies: map[string]*ratelimiter.Policy{
+				"/tier": &ratelimiter.Policy{
+					Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}},
+					Tiers:  map[string][]ratelimiter.Limit{"pro": {{Max: 3, Window: time.Second}}},
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		url := "http://" + srv.Addr().String() + "/tier"
+		res, err := RequestBy("GET", url)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("free", res.Header.Get("X-Ratelimit-Tier"))
+		res, err = RequestBy("GET", url)
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+
+		// the pro tier has its own limits and limiter key
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Tier", "pro")
+		res, err = DefaultClientDo(req)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal("pro", res.Header.Get("X-Ratelimit-Tier"))
+
+		// a tier not listed uses the limits of the policy
+		req.Header.Set("X-Tier", "team")
+		res, err = DefaultClientDo(req)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("team", res.Header.Get("X-Ratelimit-Tier"))
+	})
+
+	t.Run("RateLimiter with Resolve should be", func(t *testing.T) {
+		assert := assert.New(t)
+		var calls, errs int32
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID: ratelimiter.ByHeader("X-Tenant"),
+			Policy: map[string][]int{
+				"/resolve": []int{1, 1000},
+			},
+			Resolve: func(ctx *gear.Context) (*ratelimiter.Policy, bool) {
+				atomic.AddInt32(&calls, 1)
+				switch ctx.Get("X-Tenant") {
+				case "vip":
+					return &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Second}}}, true
+				case "internal":
+					return nil, true
+				case "wrong":
+					return &ratelimiter.Policy{}, true
+				}
+				return nil, false
+			},
+			OnError: func(ctx *gear.Context, err error) error {
+				atomic.AddInt32(&errs, 1)
+				assert.Equal(`ratelimiter: Resolve, policy "/resolve", no limits`, err.Error())
+				return nil
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		url := "http://" + srv.Addr().String() + "/resolve"
+		request := func(tenant string) *GearResponse {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Header.Set("X-Tenant", tenant)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("vip")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		res = request("vip")
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+		res = request("internal")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+
+		res = request("other")
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal(429, request("other").StatusCode)
+
+		// a wrong policy falls back to the static policy
+		res = request("wrong")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal(429, request("wrong").StatusCode)
+		assert.Equal(int32(1), atomic.LoadInt32(&errs))
+		assert.Equal(int32(4), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("RateLimiter with Exempt policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			Max: 1,
+			Policies: map[string]*ratelimiter.Policy{
+				"/health": &ratelimiter.Policy{Exempt: true},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		for i := 0; i < 3; i++ {
+			res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/health")
+			assert.Nil(err)
+			assert.Equal(200, res.StatusCode)
+			assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		}
+	})
+
+	t.Run("RateLimiter with Cost should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			Cost: func(ctx *gear.Context) int {
+				n, _ := strconv.Atoi(ctx.Get("X-Items"))
+				return n
+			},
+			IgnoreUnmatched: true,
+			Policies: map[string]*ratelimiter.Policy{
+				"/import": &ratelimiter.Policy{
+					Limits:    []ratelimiter.Limit{{Max: 10, Window: time.Minute}},
+					Algorithm: ratelimiter.FixedWindow,
+				},
+				"/search": &ratelimiter.Policy{
+					Limits:    []ratelimiter.Limit{{Max: 10, Window: time.Minute}},
+					Algorithm: ratelimiter.FixedWindow,
+					Cost:      3,
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(path, items string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			if items != "" {
+				req.Header.Set("X-Items", items)
+			}
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("/import", "4")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("6", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("/import", "7")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("6", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("/import", "")
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Remaining"))
+
+		// the static cost of the policy is used when Cost returns 0
+		res = request("/search", "")
+		assert.Equal("7", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("/search", "5")
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+
+		// Cost requires an algorithm other than Default
+		_, err := ratelimiter.NewE(&ratelimiter.Options{
+			Cost: func(ctx *gear.Context) int { return 1 },
+			Policies: map[string]*ratelimiter.Policy{
+				"/default": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 10, Window: time.Minute}}},
+				"/health":  &ratelimiter.Policy{Exempt: true},
+			},
+		})
+		assert.Equal(`ratelimiter: invalid options: policy "/default", Cost requires an algorithm other than Default; `+
+			`default policy, Cost requires an algorithm other than Default`, err.Error())
+	})
+
+	t.Run("RateLimiter with Groups should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:     ratelimiter.ByHeader("X-User"),
+			Algorithm: ratelimiter.FixedWindow,
+			Groups: map[string]*ratelimiter.Policy{
+				"heavy": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}}},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"/search/*": &ratelimiter.Policy{
+					Limits: []ratelimiter.Limit{{Max: 2, Window: time.Minute}},
+					Groups: []string{"heavy"},
+				},
+				"/export/*": &ratelimiter.Policy{
+					Limits: []ratelimiter.Limit{{Max: 2, Window: time.Minute}},
+					Groups: []string{"heavy"},
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(user, path string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			req.Header.Set("X-User", user)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("a", "/search/users")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("a", "/search/docs")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		// the group has 1 remaining, but the route is exhausted
+		assert.Equal(429, request("a", "/search/docs").StatusCode)
+
+		res = request("b", "/search/users")
+		assert.Equal(200, res.StatusCode)
+		res = request("b", "/export/users")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("b", "/export/docs")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		// the route has 1 remaining, but the group is exhausted
+		assert.Equal(429, request("b", "/search/docs").StatusCode)
+
+		err := (&ratelimiter.Options{
+			Groups: map[string]*ratelimiter.Policy{
+				"a": nil,
+				"b": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}, Groups: []string{"c"}},
+				"d": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"/x": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}, Groups: []string{"heavy"}},
+				"/y": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}, Groups: []string{"d"}},
+			},
+		}).Validate()
+		assert.Equal(`ratelimiter: invalid options: group "a" is nil; group "b", Groups should be omitted; `+
+			`group "d" requires an algorithm other than Default; policy "/x", unknown group "heavy"; `+
+			`policy "/y", Groups require an algorithm other than Default`, err.Error())
+	})
+
+	t.Run("RateLimiter with Scopes should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:     ratelimiter.ByHeader("X-User"),
+			Algorithm: ratelimiter.FixedWindow,
+			Scopes: []ratelimiter.Scope{
+				{
+					Name:   "org",
+					GetID:  ratelimiter.ByHeader("X-Org"),
+					Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}}},
+				},
+				{
+					Name:   "global",
+					GetID:  func(ctx *gear.Context) string { return "all" },
+					Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 5, Window: time.Minute}}},
+				},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"/": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 2, Window: time.Minute}}},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(user, org string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+			req.Header.Set("X-User", user)
+			if org != "" {
+				req.Header.Set("X-Org", org)
+			}
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("a", "x")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal("", res.Header.Get("X-Ratelimit-Scope"))
+		res = request("b", "x")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("b", "x")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		// user "c" has 2 remaining, but the org is exhausted
+		res = request("c", "x")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("org", res.Header.Get("X-Ratelimit-Scope"))
+
+		// rejected requests are not counted in later scopes, global has 2 remaining
+		res = request("d", "")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("e", "")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("f", "y")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+
+		err := (&ratelimiter.Options{
+			Scopes: []ratelimiter.Scope{
+				{GetID: ratelimiter.ByHeader("X-Org")},
+				{Name: "org", GetID: ratelimiter.ByHeader("X-Org"), Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 0, Window: time.Second}}}},
+				{Name: "org"},
+				{Name: "global", Policy: &ratelimiter.Policy{}},
+				{Name: "tiered", GetID: ratelimiter.ByHeader("X-Org"), Policy: &ratelimiter.Policy{
+					Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}},
+					Tiers:  map[string][]ratelimiter.Limit{"pro": {{Max: 2, Window: time.Second}}},
+				}},
+				{Name: "plain", GetID: ratelimiter.ByHeader("X-Org"), Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}}},
+			},
+		}).Validate()
+		assert.Equal(`ratelimiter: invalid options: scope 0, name should not be empty; `+
+			`scope "org", limit 0, max count should be positive, got 0; scope "org" is defined twice; `+
+			`scope "global", GetID function required; scope "tiered", Tiers should be omitted; `+
+			`scope "plain" requires an algorithm other than Default; `+
+			`default policy, Scopes require an algorithm other than Default`, err.Error())
+	})
+
+	t.Run("RateLimiter with Scopes and tiers should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:     ratelimiter.ByHeader("X-User"),
+			GetTier:   func(ctx *gear.Context) string { return ctx.Get("X-Tier") },
+			Algorithm: ratelimiter.FixedWindow,
+			Scopes: []ratelimiter.Scope{{
+				Name:   "global",
+				GetID:  func(ctx *gear.Context) string { return "all" },
+				Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}}},
+			}},
+			Policies: map[string]*ratelimiter.Policy{
+				"/": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 10, Window: time.Minute}}},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(user, tier string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+			req.Header.Set("X-User", user)
+			req.Header.Set("X-Tier", tier)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		// the global ceiling is shared by all tiers
+		assert.Equal(200, request("a", "free").StatusCode)
+		assert.Equal(200, request("b", "pro").StatusCode)
+		res := request("c", "team")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("d", "enterprise")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+	})
+
+	t.Run("RateLimiter with MaxDelay should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:     ratelimiter.ByHeader("X-User"),
+			Algorithm: ratelimiter.FixedWindow,
+			Policies: map[string]*ratelimiter.Policy{
+				"/wait": &ratelimiter.Policy{
+					Limits:   []ratelimiter.Limit{{Max: 1, Window: 500 * time.Millisecond}},
+					MaxDelay: 2 * time.Second,
+					MaxQueue: 1,
+				},
+				"/short": &ratelimiter.Policy{
+					Limits:   []ratelimiter.Limit{{Max: 1, Window: time.Second}},
+					MaxDelay: 100 * time.Millisecond,
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(c *http.Client, path string) (*http.Response, error) {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			req.Header.Set("X-User", "a")
+			return c.Do(req)
+		}
+		res, err := request(DefaultClient, "/short")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		// the wait would be longer than MaxDelay
+		res, err = request(DefaultClient, "/short")
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+
+		res, err = request(DefaultClient, "/wait")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		start := time.Now()
+		waited := make(chan int)
+		go func() {
+			res, err := request(DefaultClient, "/wait")
+			assert.Nil(err)
+			waited <- res.StatusCode
+		}()
+		time.Sleep(50 * time.Millisecond)
+		// the queue is full
+		res, err = request(DefaultClient, "/wait")
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+		assert.Equal(200, <-waited)
+		assert.True(time.Since(start) > 400*time.Millisecond)
+
+		// a canceled request leaves the queue
+		_, err = request(&http.Client{Timeout: 100 * time.Millisecond}, "/wait")
+		assert.NotNil(err)
+		time.Sleep(50 * time.Millisecond)
+		res, err = request(DefaultClient, "/wait")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+	})
+
+	t.Run("RateLimiter with CountIf should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID: ratelimiter.ByHeader("X-User"),
+			Policies: map[string]*ratelimiter.Policy{
+				"POST /login": &ratelimiter.Policy{
+					Limits:    []ratelimiter.Limit{{Max: 2, Window: time.Minute}},
+					Algorithm: ratelimiter.FixedWindow,
+					CountIf:   func(status int) bool { return status == 401 },
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			switch ctx.Get("X-Password") {
+			case "secret":
+				return ctx.HTML(200, "")
+			case "":
+				return ctx.End(401)
+			}
+			return gear.ErrUnauthorized
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		login := func(password string) *GearResponse {
+			req, _ := http.NewRequest("POST", "http://"+srv.Addr().String()+"/login", nil)
+			req.Header.Set("X-User", "a")
+			req.Header.Set("X-Password", password)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		// successful logins are not counted
+		res := login("secret")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+		res = login("secret")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+
+		// failures are counted before the response
+		assert.Equal(401, login("").StatusCode)
+		res = login("secret")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		// failures returned as errors are counted after the response
+		res = login("guess")
+		assert.Equal(401, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		for i := 0; i < 100 && login("secret").StatusCode != 429; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// blocked up front when failures are exhausted
+		res = login("guess")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.NotEqual("", res.Header.Get("Retry-After"))
+		assert.Equal(429, login("secret").StatusCode)
+	})
+
+	t.Run("RateLimiter with IETF headers should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:     ratelimiter.ByHeader("X-User"),
+			Algorithm: ratelimiter.FixedWindow,
+			Headers:   ratelimiter.HeadersIETF,
+			Policies: map[string]*ratelimiter.Policy{
+				"/a": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}, {Max: 10, Window: time.Hour}}},
+				"/b": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 5, Window: 1500 * time.Millisecond}}, Headers: ratelimiter.HeadersBoth},
+				"/c": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 5, Window: time.Second}}, Headers: ratelimiter.HeadersNone},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(path string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			req.Header.Set("X-User", "a")
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("/a")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("RateLimit-Limit"))
+		assert.Equal("0", res.Header.Get("RateLimit-Remaining"))
+		assert.Equal("60", res.Header.Get("RateLimit-Reset"))
+		assert.Equal("1;w=60, 10;w=3600", res.Header.Get("RateLimit-Policy"))
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		res = request("/a")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("0", res.Header.Get("RateLimit-Remaining"))
+		assert.NotEqual("", res.Header.Get("Retry-After"))
+
+		res = request("/b")
+		assert.Equal("4", res.Header.Get("RateLimit-Remaining"))
+		assert.Equal("5;w=2", res.Header.Get("RateLimit-Policy"))
+		assert.Equal("4", res.Header.Get("X-Ratelimit-Remaining"))
+
+		res = request("/c")
+		assert.Equal("", res.Header.Get("RateLimit-Limit"))
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+
+		err := (&ratelimiter.Options{Headers: 7, Policies: map[string]*ratelimiter.Policy{
+			"/a": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}}, Headers: ratelimiter.HeadersIETF},
+		}}).Validate()
+		assert.Equal(`ratelimiter: invalid options: default policy, unknown header mode 7`, err.Error())
+	})
+
+	t.Run("RateLimiter with OnLimited and SetHeaders should be", func(t *testing.T) {
+		assert := assert.New(t)
+		var result *ratelimiter.Result
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:       ratelimiter.ByHeader("X-User"),
+			Algorithm:   ratelimiter.FixedWindow,
+			DefaultTier: "free",
+			Groups: map[string]*ratelimiter.Policy{
+				"heavy": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}}},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"GET /users/:id": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 5, Window: time.Minute}}, Groups: []string{"heavy"}},
+				"/internal":      &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}}, Headers: ratelimiter.HeadersNone},
+				"/default":       &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}}},
+			},
+			SetHeaders: func(ctx *gear.Context, res *ratelimiter.Result) {
+				ctx.Set("X-Quota-Remaining", strconv.Itoa(res.Remaining))
+			},
+			OnLimited: func(ctx *gear.Context, res *ratelimiter.Result) error {
+				result = res
+				if ctx.Path == "/default" {
+					return nil
+				}
+				return ctx.JSON(503, map[string]interface{}{
+					"error":      "rate_limited",
+					"retryAfter": int(res.RetryAfter.Seconds()),
+				})
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(path string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			req.Header.Set("X-User", "a")
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request("/users/1")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Quota-Remaining"))
+		assert.Equal("", res.Header.Get("X-Ratelimit-Remaining"))
+		res = request("/users/2")
+		assert.Equal(503, res.StatusCode)
+		body, _ := res.Text()
+		assert.Contains(body, `"error":"rate_limited"`)
+		assert.Equal("GET /users/:id", result.PolicyKey)
+		assert.Equal("a#heavy@free", result.Key)
+		assert.Equal("heavy", result.Group)
+		assert.Equal("free", result.Tier)
+		assert.Equal([]ratelimiter.Limit{{Max: 1, Window: time.Minute}}, result.Policy.Limits)
+		assert.False(result.Allowed)
+		assert.True(result.RetryAfter > 50*time.Second)
+
+		// headers are suppressed by HeadersNone
+		assert.Equal(200, request("/internal").StatusCode)
+		res = request("/internal")
+		assert.Equal(503, res.StatusCode)
+		assert.Equal("", res.Header.Get("X-Quota-Remaining"))
+		assert.Equal("", res.Header.Get("Retry-After"))
+
+		// the default response if OnLimited writes nothing
+		assert.Equal(200, request("/default").StatusCode)
+		res = request("/default")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("/default", result.PolicyKey)
+	})
+
+	t.Run("RateLimiter with FromContext should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:           ratelimiter.ByHeader("X-User"),
+			Algorithm:       ratelimiter.FixedWindow,
+			GetTier:         func(ctx *gear.Context) string { return "pro" },
+			IgnoreUnmatched: true,
+			Cost:            func(ctx *gear.Context) int { return 2 },
+			Policies: map[string]*ratelimiter.Policy{
+				"GET /items": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 10, Window: time.Minute}}},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			res, ok := ratelimiter.FromContext(ctx)
+			if !ok {
+				return ctx.HTML(200, "none")
+			}
+			pageSize := 100
+			if res.Remaining < 5 {
+				pageSize = 10
+			}
+			return ctx.HTML(200, fmt.Sprintf("%s %s %s %d %d %d %v", res.PolicyKey, res.ID, res.Tier,
+				res.Cost, res.Remaining, pageSize, res.Reset.After(time.Now())))
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(path string) string {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+path, nil)
+			req.Header.Set("X-User", "a")
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			assert.Equal(200, res.StatusCode)
+			body, _ := res.Text()
+			return body
+		}
+		assert.Equal("GET /items a pro 2 8 100 true", request("/items"))
+		assert.Equal("GET /items a pro 2 6 100 true", request("/items"))
+		assert.Equal("GET /items a pro 2 4 10 true", request("/items"))
+		assert.Equal("none", request("/other"))
+	})
+
+	t.Run("RateLimiter with FirstOf GetID should be", func(t *testing.T) {
+		assert := assert.New(t)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			GetID:  ratelimiter.FirstOf(ratelimiter.ByHeader("X-API-Key"), ratelimiter.ByQuery("key"), ratelimiter.ByIP()),
+			Policy: map[string][]int{"/key": []int{1, 1000}},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		url := "http://" + srv.Addr().String() + "/key"
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-API-Key", "abc")
+		res, err := DefaultClientDo(req)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		res, err = RequestBy("GET", url+"?key=abc")
+		assert.Nil(err)
+		assert.Equal(429, res.StatusCode)
+		res, err = RequestBy("GET", url)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+	})
+	testcase(t, nil)
+}
+
+func TestNewE(t *testing.T) {
+	t.Run("NewE should return all problems", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter, err := ratelimiter.NewE(&ratelimiter.Options{
+			Duration: -time.Second,
+			Policy: map[string][]int{
+				"/a":       []int{1, 1000, 2},
+				"/b":       []int{1, 0},
+				"GETS /c":  []int{1, 1000},
+				"/d/*/e":   []int{1, 1000},
+				"POST /ok": []int{1, 1000},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"/f": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}}, Algorithm: "leaky"},
+			},
+		})
+		assert.Nil(limiter)
+		verr, ok := err.(*ratelimiter.ValidationError)
+		if assert.True(ok) {
+			assert.Equal(6, len(verr.Errors))
+		}
+		assert.Equal(`ratelimiter: invalid options: Duration should not be negative, got -1s; `+
+			`policy "/a", should be pairs of max count and milliseconds, got [1 1000 2]; `+
+			`policy "/b", limit 0, window should be at least 1ms, got 0s; `+
+			`invalid policy key "/d/*/e", wildcard should be the last segment; `+
+			`policy "/f", unknown algorithm "leaky"; `+
+			`invalid policy key "GETS /c", unknown method "GETS"`, err.Error())
+	})
+
+	t.Run("Validate should be", func(t *testing.T) {
+		assert := assert.New(t)
+		opts := &ratelimiter.Options{
+			GetID:  func(ctx *gear.Context) string { return "user" },
+			Policy: map[string][]int{"GET /a": []int{1, 1000}},
+		}
+		assert.Nil(opts.Validate())
+		limiter, err := ratelimiter.NewE(opts)
+		assert.Nil(err)
+		assert.NotNil(limiter)
+
+		opts.Algorithms = map[string]ratelimiter.Algorithm{"GET /b": ratelimiter.GCRA}
+		assert.Equal(`ratelimiter: invalid options: Algorithms key "GET /b" matches no policy`, opts.Validate().Error())
+
+		opts.Algorithms = nil
+		opts.Policies = map[string]*ratelimiter.Policy{"/t": &ratelimiter.Policy{
+			Limits: []ratelimiter.Limit{{Max: 1, Window: time.Second}},
+			Tiers:  map[string][]ratelimiter.Limit{"pro": {{Max: 2, Window: time.Second}}},
+		}}
+		assert.Equal(`ratelimiter: invalid options: policy "/t" has Tiers, GetTier or DefaultTier required`, opts.Validate().Error())
+
+		opts.Policies = nil
+		opts.Algorithm = ratelimiter.GCRA
+		opts.Client = &failClient{}
+		assert.Equal(`ratelimiter: invalid options: policy "GET /a", Client should implement Store for algorithm "gcra"; `+
+			`default policy, Client should implement Store for algorithm "gcra"`, opts.Validate().Error())
+	})
+}
+
+func TestUpdatePolicies(t *testing.T) {
+	newApp := func() (*ratelimiter.RateLimiter, string, func()) {
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			GetID: func(ctx *gear.Context) string {
+				return "user"
+			},
+			Policy: map[string][]int{
+				"/a": []int{2, 1000},
+				"/b": []int{1, 1000},
+			},
+			IgnoreUnmatched: true,
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		return limiter, "http://" + srv.Addr().String(), func() { srv.Close() }
+	}
+	limit := func(max int) *ratelimiter.Policy {
+		return &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: max, Window: time.Second}}}
+	}
+
+	t.Run("UpdatePolicies should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter, host, stop := newApp()
+		defer stop()
+
+		res, err := RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+
+		err = limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/a": limit(2), "/c": limit(5)})
+		assert.Nil(err)
+		// counters are kept for "/a"
+		res, err = RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		res, err = RequestBy("GET", host+"/b")
+		assert.Nil(err)
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		res, err = RequestBy("GET", host+"/c")
+		assert.Nil(err)
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Limit"))
+
+		err = limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/c": &ratelimiter.Policy{}, "GETS": limit(1)})
+		assert.Equal(`ratelimiter: invalid options: policy "/c", no limits; invalid policy key "GETS", unknown method "GETS"`, err.Error())
+		res, err = RequestBy("GET", host+"/c")
+		assert.Nil(err)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Remaining"))
+	})
+
+	t.Run("UpdatePolicies should check Algorithms like NewE", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			GetID:      ratelimiter.ByHeader("X-User"),
+			Algorithms: map[string]ratelimiter.Algorithm{"/a": ratelimiter.FixedWindow},
+			Policies:   map[string]*ratelimiter.Policy{"/a": limit(2)},
+		})
+
+		err := limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/b": limit(2)})
+		assert.Equal(`ratelimiter: invalid options: Algorithms key "/a" matches no policy`, err.Error())
+		assert.Nil(limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/a": limit(3), "/b": limit(2)}))
+	})
+
+	t.Run("UpdatePolicies should drop the results of Resolve", func(t *testing.T) {
+		assert := assert.New(t)
+		var calls, max int32 = 0, 3
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			GetID: func(ctx *gear.Context) string {
+				return "tenant"
+			},
+			Policy: map[string][]int{
+				"/a": []int{2, 1000},
+			},
+			Resolve: func(ctx *gear.Context) (*ratelimiter.Policy, bool) {
+				atomic.AddInt32(&calls, 1)
+				return limit(int(atomic.LoadInt32(&max))), true
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		host := "http://" + srv.Addr().String()
+
+		res, err := RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		atomic.StoreInt32(&max, 5)
+		res, err = RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+		assert.Nil(limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/a": limit(2)}))
+		res, err = RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal(int32(2), atomic.LoadInt32(&calls))
+		res.Body.Close()
+	})
+
+	t.Run("UpdatePolicies should be safe for concurrent use", func(t *testing.T) {
+		limiter, host, stop := newApp()
+		defer stop()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1; i < 20; i++ {
+				limiter.UpdatePolicies(map[string]*ratelimiter.Policy{"/a": limit(i)})
 			}
 		}()
-		ratelimiter.New(&ratelimiter.Options{})
+		for i := 0; i < 20; i++ {
+			if _, err := RequestBy("GET", host+"/a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+	})
+
+	t.Run("WatchPolicies should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter, host, stop := newApp()
+		defer stop()
+
+		file, err := ioutil.TempFile("", "policies")
+		assert.Nil(err)
+		defer os.Remove(file.Name())
+		write := func(content string, modTime time.Time) {
+			assert.Nil(ioutil.WriteFile(file.Name(), []byte(content), 0644))
+			assert.Nil(os.Chtimes(file.Name(), modTime, modTime))
+		}
+		parse := func(r io.Reader) (map[string]*ratelimiter.Policy, error) {
+			var m map[string][]int
+			if err := json.NewDecoder(r).Decode(&m); err != nil {
+				return nil, err
+			}
+			return ratelimiter.ConvertPolicy(m)
+		}
+		errs := make(chan error, 1)
+		now := time.Now()
+
+		_, err = limiter.WatchPolicies(file.Name(), time.Millisecond, parse, nil)
+		assert.NotNil(err)
+		write(`{"/d": [3, 1000]}`, now)
+		cancel, err := limiter.WatchPolicies(file.Name(), 10*time.Millisecond, parse, func(err error) {
+			errs <- err
+		})
+		assert.Nil(err)
+		defer cancel()
+		res, err := RequestBy("GET", host+"/d")
+		assert.Nil(err)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+
+		write(`{"/e": [4, 1000]}`, now.Add(time.Second))
+		time.Sleep(50 * time.Millisecond)
+		res, err = RequestBy("GET", host+"/d")
+		assert.Nil(err)
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		res, err = RequestBy("GET", host+"/e")
+		assert.Nil(err)
+		assert.Equal("4", res.Header.Get("X-Ratelimit-Limit"))
+
+		write(`{"/d": [4, 1000, 5]}`, now.Add(2*time.Second))
+		assert.Contains((<-errs).Error(), `policy "/d", should be pairs`)
+		res, err = RequestBy("GET", host+"/e")
+		assert.Nil(err)
+		assert.Equal("4", res.Header.Get("X-Ratelimit-Limit"))
+		cancel()
+		cancel()
+	})
+}
+
+func TestRateLimiterFailMode(t *testing.T) {
+	newApp := func(opts *ratelimiter.Options) *gear.ServerListener {
+		opts.Client = &failClient{}
+		opts.GetID = func(ctx *gear.Context) string {
+			return "user"
+		}
+		opts.Policy = map[string][]int{
+			"/a": []int{6, 5 * 1000},
+		}
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(opts))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		return app.Start()
+	}
+
+	t.Run("RateLimiter with FailOpen should be", func(t *testing.T) {
+		assert := assert.New(t)
+		var errs []error
+		srv := newApp(&ratelimiter.Options{
+			OnError: func(ctx *gear.Context, err error) error {
+				errs = append(errs, err)
+				return nil
+			},
+		})
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal(1, len(errs))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with FailClosed should be", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newApp(&ratelimiter.Options{
+			FailMode: ratelimiter.FailClosed,
+			OnError: func(ctx *gear.Context, err error) error {
+				return nil
+			},
+		})
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(503, res.StatusCode)
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with FailLocal should be", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newApp(&ratelimiter.Options{
+			FailMode: ratelimiter.FailLocal,
+			OnError: func(ctx *gear.Context, err error) error {
+				return nil
+			},
+		})
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("6", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Remaining"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with FailLocal should switch back after probe", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &flakyClient{down: 1}
+		events := make(chan bool, 2)
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			Client:        client,
+			FailMode:      ratelimiter.FailLocal,
+			Instances:     2,
+			ProbeInterval: 10 * time.Millisecond,
+			GetID: func(ctx *gear.Context) string {
+				return "user"
+			},
+			Policy: map[string][]int{
+				"/a": []int{6, 5 * 1000},
+			},
+			OnError: func(ctx *gear.Context, err error) error {
+				return nil
+			},
+			OnFallback: func(local bool, err error) {
+				events <- local
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal(true, <-events)
+
+		atomic.StoreInt32(&client.down, 0)
+		select {
+		case local := <-events:
+			assert.Equal(false, local)
+		case <-time.After(time.Second):
+			t.Error("should switch back to redis")
+		}
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with FailLocal should stop probing after Close", func(t *testing.T) {
+		assert := assert.New(t)
+		client := &flakyClient{down: 1}
+		events := make(chan bool, 2)
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client:        client,
+			FailMode:      ratelimiter.FailLocal,
+			ProbeInterval: 10 * time.Millisecond,
+			GetID: func(ctx *gear.Context) string {
+				return "user"
+			},
+			OnError: func(ctx *gear.Context, err error) error {
+				return nil
+			},
+			OnFallback: func(local bool, err error) {
+				events <- local
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		res.Body.Close()
+		assert.Equal(true, <-events)
+		assert.Nil(limiter.Close())
+		assert.Nil(limiter.Close())
+
+		atomic.StoreInt32(&client.down, 0)
+		select {
+		case <-events:
+			t.Error("should not probe after Close")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("RateLimiter with OnError returns error should be", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := newApp(&ratelimiter.Options{
+			OnError: func(ctx *gear.Context, err error) error {
+				return gear.ErrForbidden.WithMsg(err.Error())
+			},
+		})
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(403, res.StatusCode)
+		res.Body.Close()
 	})
-	testcase(t, nil)
 }
 
 func TestRateLimiterWithRedis(t *testing.T) {
@@ -151,8 +1377,78 @@ func testcase(t *testing.T, Client baselimiter.RedisClient) {
 
 		assert.Nil(err)
 		assert.Equal(200, res.StatusCode)
-		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
-		assert.Equal("", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal("100", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("99", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.NotEqual("", res.Header.Get("X-Ratelimit-Reset"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with Max and Duration should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Max:      2,
+			Duration: time.Second,
+			Policy: map[string][]int{
+				"/a": []int{6, 5 * 1000},
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/b")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/c")
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+
+		res, err = RequestBy("POST", "http://"+srv.Addr().String()+"/b")
+		assert.Equal(429, res.StatusCode)
+
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("6", res.Header.Get("X-Ratelimit-Limit"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with DefaultPolicy should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Max:           2,
+			Duration:      time.Second,
+			DefaultPolicy: []int{3, 5 * 1000},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/b")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
 		res.Body.Close()
 	})
 
@@ -547,7 +1843,13 @@ func testcase(t *testing.T, Client baselimiter.RedisClient) {
 
 	t.Run("ratelimiter with wrong multi-policy that should be", func(t *testing.T) {
 		assert := assert.New(t)
-		limiter := ratelimiter.New(&ratelimiter.Options{
+		defer func() {
+			err, _ := recover().(error)
+			if assert.NotNil(err) {
+				assert.Contains(err.Error(), `policy "/g", should be pairs of max count and milliseconds`)
+			}
+		}()
+		ratelimiter.New(&ratelimiter.Options{
 			Client: Client,
 			GetID: func(ctx *gear.Context) string {
 				return genID()
@@ -556,20 +1858,209 @@ func testcase(t *testing.T, Client baselimiter.RedisClient) {
 				"/g": []int{2, 2 * 1000, 1 * 1000, 3, 1 * 1000, 4, 10 * 1000},
 			},
 		})
+	})
+
+	t.Run("RateLimiter with typed Policies should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Policy: map[string][]int{
+				"/a": []int{6, 5 * 1000},
+			},
+			Policies: map[string]*ratelimiter.Policy{
+				"GET /users/:id": &ratelimiter.Policy{
+					Limits: []ratelimiter.Limit{{Max: 3, Window: 5 * time.Second}},
+					Key:    ratelimiter.KeyByPath,
+				},
+				"/internal/*": &ratelimiter.Policy{
+					Limits:    []ratelimiter.Limit{{Max: 5, Window: time.Second}},
+					Algorithm: ratelimiter.FixedWindow,
+					Cost:      2,
+					Headers:   ratelimiter.HeadersNone,
+				},
+			},
+		})
 		app := gear.New()
 		app.UseHandler(limiter)
-		router := gear.NewRouter()
-		router.Get("/g", func(ctx *gear.Context) error {
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		host := "http://" + srv.Addr().String()
+
+		res, err := RequestBy("GET", host+"/a")
+		assert.Nil(err)
+		assert.Equal("6", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Remaining"))
+
+		RequestBy("GET", host+"/users/1")
+		res, err = RequestBy("GET", host+"/users/1")
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res, err = RequestBy("GET", host+"/users/2")
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+
+		RequestBy("GET", host+"/internal/a")
+		res, err = RequestBy("GET", host+"/internal/b")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		res, err = RequestBy("GET", host+"/internal/c")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("", res.Header.Get("Retry-After"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with route pattern policy should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Policy: map[string][]int{
+				"GET /users/:id":         []int{3, 5 * 1000},
+				"GET /users/:id(^\\d+$)": []int{5, 5 * 1000},
+				"/users/me":              []int{10, 5 * 1000},
+				"/files/*":               []int{2, 5 * 1000},
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
 			return ctx.HTML(200, "")
 		})
-		app.UseHandler(router)
 
 		srv := app.Start()
 		defer srv.Close()
-		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/g")
+		host := "http://" + srv.Addr().String()
+		res, err := RequestBy("GET", host+"/users/123")
+		assert.Nil(err)
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("4", res.Header.Get("X-Ratelimit-Remaining"))
+		res, err = RequestBy("GET", host+"/users/456")
+		assert.Equal("5", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Remaining"))
+
+		res, err = RequestBy("GET", host+"/users/abc")
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Remaining"))
+
+		res, err = RequestBy("GET", host+"/users/me")
+		assert.Equal("10", res.Header.Get("X-Ratelimit-Limit"))
+
+		res, err = RequestBy("GET", host+"/files/a/b.txt")
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		RequestBy("GET", host+"/files/c.txt")
+		res, err = RequestBy("POST", host+"/files/d.txt")
+		assert.Equal(429, res.StatusCode)
+
+		res, err = RequestBy("POST", host+"/users/123")
+		assert.Equal("100", res.Header.Get("X-Ratelimit-Limit"))
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with TokenBucket algorithm should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Algorithm: ratelimiter.TokenBucket,
+			Burst:     2,
+			Policy: map[string][]int{
+				"/a": []int{10, 1000},
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		res, err := RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/a")
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal("1", res.Header.Get("Retry-After"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Contains(string(body), "retry in 1 seconds")
+
+		time.Sleep(120 * time.Millisecond)
+		res, err = RequestBy("GET", "http://"+srv.Addr().String()+"/a")
 		assert.Equal(200, res.StatusCode)
+		res.Body.Close()
+	})
+
+	t.Run("RateLimiter with Algorithms should be", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := genID()
+		limiter := ratelimiter.New(&ratelimiter.Options{
+			Client: Client,
+			GetID: func(ctx *gear.Context) string {
+				return id
+			},
+			Algorithms: map[string]ratelimiter.Algorithm{
+				"/a": ratelimiter.SlidingLog,
+				"/b": ratelimiter.GCRA,
+			},
+			Policy: map[string][]int{
+				"/a": []int{3, 1000, 2, 100},
+				"/b": []int{2, 1000},
+				"/c": []int{2, 1000},
+			},
+		})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+		host := "http://" + srv.Addr().String()
+
+		// both limits of /a are checked, the most exhausted one is reported
+		res, err := RequestBy("GET", host+"/a")
 		assert.Nil(err)
-		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res, err = RequestBy("GET", host+"/a")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+		time.Sleep(120 * time.Millisecond)
+		res, err = RequestBy("GET", host+"/a")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("3", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+
+		RequestBy("GET", host+"/b")
+		RequestBy("GET", host+"/b")
+		res, err = RequestBy("GET", host+"/b")
+		assert.Equal(429, res.StatusCode)
+
+		res, err = RequestBy("GET", host+"/c")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("2", res.Header.Get("X-Ratelimit-Limit"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+		res.Body.Close()
 	})
 
 	t.Run("RateLimiter without limited should be", func(t *testing.T) {
@@ -580,6 +2071,7 @@ func testcase(t *testing.T, Client baselimiter.RedisClient) {
 			GetID: func(ctx *gear.Context) string {
 				return genID()
 			},
+			IgnoreUnmatched: true,
 			Policy: map[string][]int{
 				"/h": []int{6, 5 * 1000},
 			},
@@ -601,4 +2093,264 @@ func testcase(t *testing.T, Client baselimiter.RedisClient) {
 		assert.Equal("", res.Header.Get("X-Ratelimit-Limit"))
 		res.Body.Close()
 	})
+
+	t.Run("RateLimiter with RefundIf should be", func(t *testing.T) {
+		algorithms := []ratelimiter.Algorithm{ratelimiter.FixedWindow, ratelimiter.SlidingWindow,
+			ratelimiter.SlidingLog, ratelimiter.TokenBucket, ratelimiter.GCRA}
+		for _, alg := range algorithms {
+			t.Run(string(alg), func(t *testing.T) {
+				assert := assert.New(t)
+				user := genID()
+				app := gear.New()
+				app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+					Client:    Client,
+					GetID:     ratelimiter.ByHeader("X-User"),
+					Algorithm: alg,
+					Groups: map[string]*ratelimiter.Policy{
+						"api": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}}},
+					},
+					Policies: map[string]*ratelimiter.Policy{
+						"/items": &ratelimiter.Policy{
+							Limits: []ratelimiter.Limit{{Max: 2, Window: time.Minute}},
+							Groups: []string{"api"},
+							RefundIf: func(ctx *gear.Context) bool {
+								return ctx.Res.Status() == 304 || ctx.Res.Status() == 422
+							},
+						},
+					},
+				}))
+				app.Use(func(ctx *gear.Context) error {
+					switch ctx.Get("X-Result") {
+					case "cached":
+						return ctx.End(304)
+					case "invalid":
+						return gear.ErrBadRequest.WithCode(422)
+					case "error":
+						return gear.ErrBadRequest
+					}
+					return ctx.HTML(200, "")
+				})
+				srv := app.Start()
+				defer srv.Close()
+
+				request := func(result string) *GearResponse {
+					req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/items", nil)
+					req.Header.Set("X-User", user)
+					req.Header.Set("X-Result", result)
+					res, err := DefaultClientDo(req)
+					assert.Nil(err)
+					return res
+				}
+				res := request("cached")
+				assert.Equal(304, res.StatusCode)
+				assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+				res = request("invalid")
+				assert.Equal(422, res.StatusCode)
+				// errors are refunded after the response, cached requests before it
+				for i := 0; i < 100 && request("cached").Header.Get("X-Ratelimit-Remaining") != "1"; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				// the costs were given back to the policy and the group
+				res = request("")
+				assert.Equal(200, res.StatusCode)
+				assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+				assert.Equal(400, request("error").StatusCode)
+				res = request("")
+				assert.Equal(429, res.StatusCode)
+			})
+		}
+	})
+
+	t.Run("RateLimiter should not count rejected requests", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// run takes 2 requests of a client, then one rejected by the global scope, and returns
+		// a request of the client out of the scope.
+		run := func(client baselimiter.RedisClient) *GearResponse {
+			user, global := genID(), genID()
+			app := gear.New()
+			app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+				Client:    client,
+				GetID:     func(ctx *gear.Context) string { return user },
+				Algorithm: ratelimiter.FixedWindow,
+				Scopes: []ratelimiter.Scope{{
+					Name:   "global",
+					GetID:  func(ctx *gear.Context) string { return ctx.Get("X-Global") },
+					Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 2, Window: time.Minute}}},
+				}},
+				Policies: map[string]*ratelimiter.Policy{
+					"/": &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}, {Max: 5, Window: time.Hour}}},
+				},
+			}))
+			app.Use(func(ctx *gear.Context) error {
+				return ctx.HTML(200, "")
+			})
+			srv := app.Start()
+			defer srv.Close()
+
+			request := func(global string) *GearResponse {
+				req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+				req.Header.Set("X-Global", global)
+				res, err := DefaultClientDo(req)
+				assert.Nil(err)
+				return res
+			}
+			assert.Equal(200, request(global).StatusCode)
+			assert.Equal(200, request(global).StatusCode)
+			res := request(global)
+			assert.Equal(429, res.StatusCode)
+			assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+			return request("")
+		}
+
+		// the rejected request didn't take the limits of the client
+		res := run(Client)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("0", res.Header.Get("X-Ratelimit-Remaining"))
+
+		if c, ok := Client.(storeClient); ok {
+			// without TakeAll, like DefaultClusterClient, the limits of the client were taken
+			// before the scope rejected the request
+			res = run(takeClient{c})
+			assert.Equal(429, res.StatusCode)
+			assert.Equal("", res.Header.Get("X-Ratelimit-Scope"))
+		}
+	})
+
+	t.Run("RateLimiter should not count requests rejected by a later scope", func(t *testing.T) {
+		assert := assert.New(t)
+
+		org, global := genID(), genID()
+		app := gear.New()
+		app.UseHandler(ratelimiter.New(&ratelimiter.Options{
+			Client:    Client,
+			GetID:     ratelimiter.ByHeader("X-User"),
+			Algorithm: ratelimiter.FixedWindow,
+			Scopes: []ratelimiter.Scope{
+				{
+					Name:   "org",
+					GetID:  func(ctx *gear.Context) string { return org },
+					Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 3, Window: time.Minute}}},
+				},
+				{
+					Name:   "global",
+					GetID:  func(ctx *gear.Context) string { return ctx.Get("X-Global") },
+					Policy: &ratelimiter.Policy{Limits: []ratelimiter.Limit{{Max: 1, Window: time.Minute}}},
+				},
+			},
+		}))
+		app.Use(func(ctx *gear.Context) error {
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(global string) *GearResponse {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/", nil)
+			req.Header.Set("X-User", genID())
+			req.Header.Set("X-Global", global)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res
+		}
+		res := request(global)
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+		res = request(global)
+		assert.Equal(429, res.StatusCode)
+		assert.Equal("global", res.Header.Get("X-Ratelimit-Scope"))
+		// the org counted the first request only
+		res = request("")
+		assert.Equal(200, res.StatusCode)
+		assert.Equal("org", res.Header.Get("X-Ratelimit-Scope"))
+		assert.Equal("1", res.Header.Get("X-Ratelimit-Remaining"))
+	})
+
+	t.Run("ConcurrencyLimiter should be", func(t *testing.T) {
+		assert := assert.New(t)
+		limiter, err := ratelimiter.NewConcurrencyLimiter(&ratelimiter.ConcurrencyOptions{
+			Client: Client,
+			Prefix: "LIMIT:" + genID() + ":",
+			GetID:  ratelimiter.ByHeader("X-User"),
+			Policies: map[string]*ratelimiter.ConcurrencyPolicy{
+				"/slow": &ratelimiter.ConcurrencyPolicy{PerClient: 1, Total: 2},
+			},
+		})
+		assert.Nil(err)
+		started := make(chan struct{}, 2)
+		release := make(chan struct{})
+		app := gear.New()
+		app.UseHandler(limiter)
+		app.Use(func(ctx *gear.Context) error {
+			switch ctx.Get("X-Action") {
+			case "wait":
+				started <- struct{}{}
+				<-release
+			case "panic":
+				panic("oops")
+			}
+			return ctx.HTML(200, "")
+		})
+		srv := app.Start()
+		defer srv.Close()
+
+		request := func(user, action string) int {
+			req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/slow", nil)
+			req.Header.Set("X-User", user)
+			req.Header.Set("X-Action", action)
+			res, err := DefaultClientDo(req)
+			assert.Nil(err)
+			return res.StatusCode
+		}
+		waiting := make(chan int, 2)
+		for _, user := range []string{"a", "b"} {
+			go func(user string) { waiting <- request(user, "wait") }(user)
+		}
+		// wait until both requests hold their leases
+		<-started
+		<-started
+		assert.Equal(429, request("a", ""))
+		assert.Equal(429, request("c", ""))
+		close(release)
+		assert.Equal(200, <-waiting)
+		assert.Equal(200, <-waiting)
+
+		// leases are released before the response
+		assert.Equal(200, request("a", ""))
+		assert.Equal(200, request("a", ""))
+
+		// leases are released after the response when a handler panics
+		released := func(user string) bool {
+			for i := 0; i < 100; i++ {
+				if request(user, "") == 200 {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+		assert.Equal(500, request("a", "panic"))
+		assert.True(released("a"))
+		assert.Equal(500, request("a", "panic"))
+		assert.True(released("a"))
+
+		// routes without policy are not limited
+		req, _ := http.NewRequest("GET", "http://"+srv.Addr().String()+"/fast", nil)
+		res, err := DefaultClientDo(req)
+		assert.Nil(err)
+		assert.Equal(200, res.StatusCode)
+
+		_, err = ratelimiter.NewConcurrencyLimiter(&ratelimiter.ConcurrencyOptions{
+			Client:   &failClient{},
+			FailMode: ratelimiter.FailLocal,
+			Policies: map[string]*ratelimiter.ConcurrencyPolicy{
+				"/a": nil,
+				"/b": &ratelimiter.ConcurrencyPolicy{PerClient: -1},
+				"b":  &ratelimiter.ConcurrencyPolicy{},
+			},
+		})
+		assert.Equal(`ratelimiter: invalid options: Client should implement LeaseStore; FailMode should be FailOpen or FailClosed, got 2; `+
+			`policy "/a" is nil; policy "/b", caps should not be negative, got -1 and 0; `+
+			`invalid policy key "b", unknown method "b"`, err.Error())
+	})
 }
@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"time"
+
+	ratelimiter "github.com/teambition/gear-ratelimiter"
+	baselimiter "github.com/teambition/ratelimiter-go"
+)
+
+// acquireLua adds a lease to every sorted set of KEYS if none of them is full, scored by its expire time.
+// ARGV: now (ms), ttl (ms), lease id, then the max of every key.
+// It returns -1, or the index of the first full key.
+const acquireLua = `
+local now, ttl, id = tonumber(ARGV[1]), tonumber(ARGV[2]), ARGV[3]
+for i, key in ipairs(KEYS) do
+  redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+  if redis.call('ZCARD', key) >= tonumber(ARGV[3 + i]) then
+    return i - 1
+  end
+end
+for i, key in ipairs(KEYS) do
+  redis.call('ZADD', key, now + ttl, id)
+  redis.call('PEXPIRE', key, ttl)
+end
+return -1
+`
+
+// releaseLua removes the lease ARGV[1] from KEYS.
+const releaseLua = `
+for i, key in ipairs(KEYS) do
+  redis.call('ZREM', key, ARGV[1])
+end
+return 0
+`
+
+var (
+	acquireScript = newScript(acquireLua)
+	releaseScript = newScript(releaseLua)
+)
+
+func acquire(c baselimiter.RedisClient, id string, leases []ratelimiter.Lease, ttl time.Duration) (int, error) {
+	keys := make([]string, len(leases))
+	args := make([]interface{}, 3, 3+len(leases))
+	args[0], args[1], args[2] = time.Now().UnixNano()/1e6, int64(ttl/time.Millisecond), id
+	for i, lease := range leases {
+		keys[i] = lease.Key
+		args = append(args, lease.Max)
+	}
+	res, err := acquireScript.eval(c, keys, args...)
+	if err != nil {
+		return 0, err
+	}
+	full, ok := res.(int64)
+	if !ok {
+		return 0, errInvalidResult
+	}
+	return int(full), nil
+}
+
+func release(c baselimiter.RedisClient, id string, leases []ratelimiter.Lease) error {
+	keys := make([]string, len(leases))
+	for i, lease := range leases {
+		keys[i] = lease.Key
+	}
+	_, err := releaseScript.eval(c, keys, id)
+	return err
+}
+
+// Acquire implements ratelimiter.LeaseStore with a redis script.
+func (c *DefaultRedisClient) Acquire(id string, leases []ratelimiter.Lease, ttl time.Duration) (int, error) {
+	return acquire(c, id, leases, ttl)
+}
+
+// Release implements ratelimiter.LeaseStore with a redis script.
+func (c *DefaultRedisClient) Release(id string, leases []ratelimiter.Lease) error {
+	return release(c, id, leases)
+}
+
+// Acquire implements ratelimiter.LeaseStore with a redis script. The keys are in different
+// hash slots, so leases are acquired in turn, and released again if a later one is full.
+func (c *DefaultClusterClient) Acquire(id string, leases []ratelimiter.Lease, ttl time.Duration) (int, error) {
+	for i := range leases {
+		full, err := acquire(c, id, leases[i:i+1], ttl)
+		if err == nil && full < 0 {
+			continue
+		}
+		if i > 0 {
+			if e := c.Release(id, leases[:i]); e != nil && err == nil {
+				err = e
+			}
+		}
+		return i, err
+	}
+	return -1, nil
+}
+
+// Release implements ratelimiter.LeaseStore with a redis script.
+func (c *DefaultClusterClient) Release(id string, leases []ratelimiter.Lease) error {
+	var err error
+	for i := range leases {
+		if e := release(c, id, leases[i:i+1]); e != nil {
+			err = e
+		}
+	}
+	return err
+}
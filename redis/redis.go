@@ -13,7 +13,8 @@ func NewRedisClient(opts *redis.Options) baselimiter.RedisClient {
 	return &DefaultRedisClient{client}
 }
 
-// NewClusterClient returns a new RedisClient with redis cluster options.
+// NewClusterClient returns a new RedisClient with redis cluster options. Its keys are taken
+// in turn, not atomically, see DefaultClusterClient.Take.
 func NewClusterClient(opts *redis.ClusterOptions) baselimiter.RedisClient {
 	client := redis.NewClusterClient(opts)
 	return &DefaultClusterClient{client}
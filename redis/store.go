@@ -0,0 +1,310 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	ratelimiter "github.com/teambition/gear-ratelimiter"
+	baselimiter "github.com/teambition/ratelimiter-go"
+)
+
+// takeLua runs algorithms of ratelimiter.Store on KEYS, and writes their states only if all
+// keys allow the request, so a rejected request consumes nothing.
+// ARGV: now (ms), then algorithm, max, window (ms), burst, cost for every key, a key with cost 0 is not written.
+// It returns {allowed, total, remaining, reset (ms), retry after (ms)} for every key.
+const takeLua = `
+-- every algorithm checks a key, and returns its result and a function writing the new state if allowed.
+local function fixedWindow(key, max, window, burst, cost, now)
+  local v = redis.call('HMGET', key, 'c', 's')
+  local count, start = tonumber(v[1]) or 0, tonumber(v[2])
+  if not start or start + window <= now then
+    count, start = 0, now
+  end
+  local reset = start + window
+  if count + cost > max then
+    return {0, max, max - count, reset, reset - now}
+  end
+  count = count + cost
+  return {1, max, max - count, reset, 0}, function()
+    redis.call('HMSET', key, 'c', count, 's', start)
+    redis.call('PEXPIREAT', key, reset)
+  end
+end
+
+local function slidingWindow(key, max, window, burst, cost, now)
+  local start = now - now % window
+  local v = redis.call('HMGET', key, 's', 'c', 'p')
+  local s, count, prev = tonumber(v[1]), tonumber(v[2]) or 0, tonumber(v[3]) or 0
+  if s ~= start then
+    if s == start - window then prev = count else prev = 0 end
+    count = 0
+  end
+  local used = math.ceil(prev * (1 - (now - start) / window)) + count
+  local reset = start + window
+  if used + cost <= max then
+    count, used = count + cost, used + cost
+    return {1, max, math.max(max - used, 0), reset, 0}, function()
+      redis.call('HMSET', key, 's', start, 'c', count, 'p', prev)
+      redis.call('PEXPIREAT', key, start + 2 * window)
+    end
+  end
+  local retry = reset - now
+  if max - cost - count >= 0 and prev > 0 then
+    retry = math.ceil((1 - (max - cost - count) / prev) * window) - (now - start)
+  end
+  return {0, max, math.max(max - used, 0), reset, retry}
+end
+
+local function slidingLog(key, max, window, burst, cost, now)
+  redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+  local entries = redis.call('ZRANGE', key, 0, -1, 'WITHSCORES')
+  local used = 0
+  for i = 1, #entries, 2 do
+    used = used + tonumber(string.match(entries[i], ':(%d+)$'))
+  end
+  if used + cost <= max then
+    used = used + cost
+    return {1, max, math.max(max - used, 0), now + window, 0}, function()
+      -- members are unique: entries added in the same millisecond have different counts
+      redis.call('ZADD', key, now, now .. ':' .. (#entries / 2) .. ':' .. cost)
+      redis.call('PEXPIRE', key, window)
+    end
+  end
+  local need, retry = used + cost - max, window
+  for i = 1, #entries, 2 do
+    need = need - tonumber(string.match(entries[i], ':(%d+)$'))
+    if need <= 0 then
+      retry = tonumber(entries[i + 1]) + window - now
+      break
+    end
+  end
+  local reset = now
+  if #entries > 0 then reset = tonumber(entries[#entries]) + window end
+  return {0, max, math.max(max - used, 0), reset, retry}
+end
+
+local function tokenBucket(key, max, window, burst, cost, now)
+  local rate = max / window
+  local v = redis.call('HMGET', key, 't', 'l')
+  local tokens = tonumber(v[1])
+  if tokens then
+    tokens = math.min(burst, tokens + math.max(now - tonumber(v[2]), 0) * rate)
+  else
+    tokens = burst
+  end
+  if tokens < cost then
+    local reset = now + math.ceil((burst - tokens) / rate)
+    return {0, burst, math.floor(tokens), reset, math.ceil((cost - tokens) / rate)}
+  end
+  tokens = tokens - cost
+  local reset = now + math.ceil((burst - tokens) / rate)
+  return {1, burst, math.floor(tokens), reset, 0}, function()
+    redis.call('HMSET', key, 't', tokens, 'l', now)
+    redis.call('PEXPIREAT', key, reset)
+  end
+end
+
+local function gcra(key, max, window, burst, cost, now)
+  local interval = window / max
+  local tat = math.max(tonumber(redis.call('GET', key)) or now, now)
+  local allowAt = tat + (cost - burst) * interval
+  if now < allowAt then
+    return {0, burst, math.floor((now + burst * interval - tat) / interval), math.ceil(tat), math.ceil(allowAt - now)}
+  end
+  tat = tat + cost * interval
+  return {1, burst, math.floor((now + burst * interval - tat) / interval), math.ceil(tat), 0}, function()
+    redis.call('SET', key, tat, 'PX', math.max(math.ceil(tat - now), 1))
+  end
+end
+
+local algorithms = {
+  ['fixed-window'] = fixedWindow,
+  ['sliding-window'] = slidingWindow,
+  ['sliding-log'] = slidingLog,
+  ['token-bucket'] = tokenBucket,
+  ['gcra'] = gcra,
+}
+
+local now = tonumber(ARGV[1])
+local results, writes, allowed = {}, {}, true
+for i, key in ipairs(KEYS) do
+  local j = 2 + (i - 1) * 5
+  local fn = algorithms[ARGV[j]]
+  if not fn then
+    return redis.error_reply('ratelimiter: unknown algorithm')
+  end
+  local max, burst = tonumber(ARGV[j + 1]), tonumber(ARGV[j + 3])
+  if burst <= 0 then burst = max end
+  results[i], writes[i] = fn(key, max, tonumber(ARGV[j + 2]), burst, tonumber(ARGV[j + 4]), now)
+  allowed = allowed and results[i][1] == 1
+end
+if allowed then
+  for i = 1, #KEYS do
+    if tonumber(ARGV[i * 5 + 1]) > 0 then writes[i]() end
+  end
+end
+return results
+`
+
+// refundLua gives the cost back to KEYS, with the same ARGV as takeLua. Counts don't go below
+// zero, buckets don't go over their capacity, and expired keys are not changed.
+const refundLua = `
+local now = tonumber(ARGV[1])
+for i, key in ipairs(KEYS) do
+  local j = 2 + (i - 1) * 5
+  local alg, max, window = ARGV[j], tonumber(ARGV[j + 1]), tonumber(ARGV[j + 2])
+  local burst, cost = tonumber(ARGV[j + 3]), tonumber(ARGV[j + 4])
+  if burst <= 0 then burst = max end
+  if alg == 'fixed-window' or alg == 'sliding-window' then
+    local count = tonumber(redis.call('HGET', key, 'c'))
+    if count then redis.call('HSET', key, 'c', math.max(count - cost, 0)) end
+  elseif alg == 'sliding-log' then
+    -- remove the latest entry of the cost
+    local entries = redis.call('ZREVRANGE', key, 0, -1)
+    for _, entry in ipairs(entries) do
+      if tonumber(string.match(entry, ':(%d+)$')) == cost then
+        redis.call('ZREM', key, entry)
+        break
+      end
+    end
+  elseif alg == 'token-bucket' then
+    local tokens = tonumber(redis.call('HGET', key, 't'))
+    if tokens then redis.call('HSET', key, 't', math.min(tokens + cost, burst)) end
+  elseif alg == 'gcra' then
+    local tat = tonumber(redis.call('GET', key))
+    if tat then
+      tat = tat - cost * window / max
+      if tat > now then
+        redis.call('SET', key, tat, 'PX', math.ceil(tat - now))
+      else
+        redis.call('DEL', key)
+      end
+    end
+  end
+end
+return 0
+`
+
+// script is a lua script run by EVALSHA, it is loaded when redis doesn't have it.
+type script struct {
+	src  string
+	sha1 string
+}
+
+func newScript(src string) *script {
+	sum := sha1.Sum([]byte(src))
+	return &script{src: src, sha1: hex.EncodeToString(sum[:])}
+}
+
+func (s *script) eval(c baselimiter.RedisClient, keys []string, args ...interface{}) (interface{}, error) {
+	res, err := c.RateEvalSha(s.sha1, keys, args...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if _, err = c.RateScriptLoad(s.src); err == nil {
+			res, err = c.RateEvalSha(s.sha1, keys, args...)
+		}
+	}
+	return res, err
+}
+
+var (
+	takeScript   = newScript(takeLua)
+	refundScript = newScript(refundLua)
+)
+
+var errInvalidResult = errors.New("ratelimiter: invalid result from redis")
+
+// scriptArgs returns the KEYS and ARGV of takeLua and refundLua.
+func scriptArgs(reqs []ratelimiter.Request) ([]string, []interface{}) {
+	keys := make([]string, len(reqs))
+	args := make([]interface{}, 1, 1+5*len(reqs))
+	args[0] = time.Now().UnixNano() / 1e6
+	for i, req := range reqs {
+		keys[i] = req.Key
+		args = append(args, string(req.Algorithm), req.Limit.Max, int64(req.Limit.Window/time.Millisecond), req.Burst, req.Cost)
+	}
+	return keys, args
+}
+
+// takeAll runs the requests by one script call.
+func takeAll(c baselimiter.RedisClient, reqs []ratelimiter.Request) ([]ratelimiter.Usage, error) {
+	keys, args := scriptArgs(reqs)
+	res, err := takeScript.eval(c, keys, args...)
+	if err != nil {
+		return nil, err
+	}
+	results, ok := res.([]interface{})
+	if !ok || len(results) != len(reqs) {
+		return nil, errInvalidResult
+	}
+	us := make([]ratelimiter.Usage, len(reqs))
+	for i, result := range results {
+		vals, ok := result.([]interface{})
+		if !ok || len(vals) != 5 {
+			return nil, errInvalidResult
+		}
+		n := make([]int64, len(vals))
+		for j, val := range vals {
+			if n[j], ok = val.(int64); !ok {
+				return nil, errInvalidResult
+			}
+		}
+		us[i] = ratelimiter.Usage{
+			Allowed:    n[0] == 1,
+			Total:      int(n[1]),
+			Remaining:  int(n[2]),
+			Reset:      time.Unix(0, n[3]*1e6),
+			RetryAfter: time.Duration(n[4]) * time.Millisecond,
+		}
+	}
+	return us, nil
+}
+
+func take(c baselimiter.RedisClient, req ratelimiter.Request) (ratelimiter.Usage, error) {
+	us, err := takeAll(c, []ratelimiter.Request{req})
+	if err != nil {
+		return ratelimiter.Usage{}, err
+	}
+	return us[0], nil
+}
+
+func refund(c baselimiter.RedisClient, reqs []ratelimiter.Request) error {
+	keys, args := scriptArgs(reqs)
+	_, err := refundScript.eval(c, keys, args...)
+	return err
+}
+
+// Take implements ratelimiter.Store with a redis script.
+func (c *DefaultRedisClient) Take(req ratelimiter.Request) (ratelimiter.Usage, error) {
+	return take(c, req)
+}
+
+// TakeAll implements ratelimiter.BatchStore with a redis script, all requests are checked in one round trip.
+func (c *DefaultRedisClient) TakeAll(reqs []ratelimiter.Request) ([]ratelimiter.Usage, error) {
+	return takeAll(c, reqs)
+}
+
+// Take implements ratelimiter.Store with a redis script. DefaultClusterClient doesn't implement
+// ratelimiter.BatchStore, the keys of a request are in different hash slots, so they are taken in turn,
+// and a request rejected by a later key, such as a scope, still consumes the keys taken before it.
+func (c *DefaultClusterClient) Take(req ratelimiter.Request) (ratelimiter.Usage, error) {
+	return take(c, req)
+}
+
+// Refund implements ratelimiter.RefundStore with a redis script.
+func (c *DefaultRedisClient) Refund(reqs []ratelimiter.Request) error {
+	return refund(c, reqs)
+}
+
+// Refund implements ratelimiter.RefundStore with a redis script, keys are refunded in turn.
+func (c *DefaultClusterClient) Refund(reqs []ratelimiter.Request) error {
+	var err error
+	for i := range reqs {
+		if e := refund(c, reqs[i:i+1]); e != nil {
+			err = e
+		}
+	}
+	return err
+}
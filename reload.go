@@ -0,0 +1,92 @@
+package ratelimiter
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// UpdatePolicies replaces the policies of Options.Policy and Options.Policies at runtime,
+// it is safe to call while requests are served. The policies are checked like NewE, every key
+// of Options.Algorithms should still have a policy, and a *ValidationError is returned for
+// wrong policies, the current policies are kept then.
+// Counters are kept for policy keys in both sets, with Default algorithm, changed limits
+// apply when the current window of a client ends. The default policy is not changed.
+// Cached results of Options.Resolve are dropped, so Resolve is called again.
+func (l *RateLimiter) UpdatePolicies(policies map[string]*Policy) error {
+	set, errs := l.options.compilePolicies(policies, l.store)
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	l.set.Store(set)
+	if l.resolved != nil {
+		l.resolved.clear()
+	}
+	return nil
+}
+
+// WatchPolicies loads the policies from a file by parse and updates them, and then reloads
+// them every time the modification time of the file changes, it is checked every interval,
+// default is 10 seconds. An error of the first load is returned, later errors are reported to
+// onError, or written by the standard logger if onError is nil, and the current policies are
+// kept. It returns a function to stop watching.
+func (l *RateLimiter) WatchPolicies(path string, interval time.Duration, parse func(r io.Reader) (map[string]*Policy, error),
+	onError func(err error)) (stop func(), err error) {
+	modTime, err := l.loadPolicies(path, parse, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if onError == nil {
+		onError = func(err error) {
+			log.Printf("ratelimiter: reload policies from %s, %v", path, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t, err := l.loadPolicies(path, parse, modTime)
+				if err != nil {
+					onError(err)
+				}
+				// a wrong file is not loaded again until it changes
+				modTime = t
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+// loadPolicies updates the policies from the file if it was modified after modTime,
+// it returns the modification time of the file.
+func (l *RateLimiter) loadPolicies(path string, parse func(r io.Reader) (map[string]*Policy, error), modTime time.Time) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return modTime, err
+	}
+	if info.ModTime().Equal(modTime) {
+		return modTime, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return modTime, err
+	}
+	defer f.Close()
+	policies, err := parse(f)
+	if err == nil {
+		err = l.UpdatePolicies(policies)
+	}
+	return info.ModTime(), err
+}
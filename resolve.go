@@ -0,0 +1,88 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/teambition/gear"
+)
+
+// resolved is a cached result of Options.Resolve.
+type resolved struct {
+	policy *Policy // compiled policy, nil if the request is not limited
+	ok     bool
+	expire time.Time
+}
+
+// resolveCache caches the results of Options.Resolve by identity and policy key.
+type resolveCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]resolved
+	sweep time.Time
+}
+
+func newResolveCache(ttl time.Duration) *resolveCache {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &resolveCache{ttl: ttl, items: make(map[string]resolved), sweep: time.Now().Add(ttl)}
+}
+
+func (c *resolveCache) get(key string, now time.Time) (resolved, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.items[key]
+	if !ok || !now.Before(r.expire) {
+		return r, false
+	}
+	return r, true
+}
+
+func (c *resolveCache) set(key string, r resolved, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// remove expired results from time to time, so that the cache doesn't grow with identities.
+	if now.After(c.sweep) {
+		for k, item := range c.items {
+			if !now.Before(item.expire) {
+				delete(c.items, k)
+			}
+		}
+		c.sweep = now.Add(c.ttl)
+	}
+	r.expire = now.Add(c.ttl)
+	c.items[key] = r
+}
+
+// clear removes all results, such as when the policies are updated.
+func (c *resolveCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]resolved)
+}
+
+// resolve returns the compiled policy of Options.Resolve for the request, ok is false if
+// the static policy should be used. key is the matched policy key, "" if none matched.
+func (l *RateLimiter) resolve(ctx *gear.Context, id, key string) (p *Policy, ok bool, err error) {
+	now := time.Now()
+	cacheKey := id + "\n" + key
+	if r, hit := l.resolved.get(cacheKey, now); hit {
+		return r.policy, r.ok, nil
+	}
+
+	p, ok = l.options.Resolve(ctx)
+	if ok && p != nil {
+		if p, err = p.compile(key, l.options); err == nil {
+			err = checkPolicy(fmt.Sprintf("policy %q", key), p, l.options, l.store)
+		}
+		if err != nil {
+			// the static policy is used until the result expires
+			l.resolved.set(cacheKey, resolved{}, now)
+			return nil, false, fmt.Errorf("ratelimiter: Resolve, %v", err)
+		}
+	}
+	l.resolved.set(cacheKey, resolved{policy: p, ok: ok}, now)
+	return p, ok, nil
+}
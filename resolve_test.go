@@ -0,0 +1,33 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveCache(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	c := newResolveCache(time.Second)
+	p := &Policy{}
+	c.set("a", resolved{policy: p, ok: true}, now)
+	r, hit := c.get("a", now.Add(999*time.Millisecond))
+	assert.True(hit)
+	assert.True(r.ok)
+	assert.Equal(p, r.policy)
+	_, hit = c.get("a", now.Add(time.Second))
+	assert.False(hit)
+	_, hit = c.get("b", now)
+	assert.False(hit)
+
+	// expired results are removed when the cache is swept
+	c.set("b", resolved{}, now.Add(1500*time.Millisecond))
+	assert.Equal(1, len(c.items))
+	assert.Equal(time.Minute, newResolveCache(0).ttl)
+
+	c.clear()
+	_, hit = c.get("b", now.Add(1500*time.Millisecond))
+	assert.False(hit)
+}
@@ -0,0 +1,63 @@
+package ratelimiter
+
+import (
+	"fmt"
+
+	"github.com/teambition/gear"
+)
+
+// Scope is an extra identity a request is limited by, such as the organization of a user
+// or the whole service.
+type Scope struct {
+	// Name of the scope, such as "org", it is set in the X-Ratelimit-Scope header
+	// when the scope is the most exhausted one.
+	Name string
+	// GetID returns the id of a request in the scope, such as the organization id, or a constant
+	// for a service-wide ceiling. Requests with an empty id are not limited by the scope.
+	GetID func(ctx *gear.Context) string
+	// Policy of the scope, all requests with the same id in the scope share one limiter key,
+	// whatever their tier, so Tiers should be omitted.
+	Policy *Policy
+}
+
+// compileScopes checks scopes and returns them with compiled policies.
+func (opts *Options) compileScopes(store Store) ([]Scope, []error) {
+	var errs []error
+	scopes := make([]Scope, 0, len(opts.Scopes))
+	names := make(map[string]bool, len(opts.Scopes))
+	for i, s := range opts.Scopes {
+		name := fmt.Sprintf("scope %q", s.Name)
+		switch {
+		case s.Name == "":
+			errs = append(errs, fmt.Errorf("scope %d, name should not be empty", i))
+		case names[s.Name]:
+			errs = append(errs, fmt.Errorf("%s is defined twice", name))
+		case s.GetID == nil:
+			errs = append(errs, fmt.Errorf("%s, GetID function required", name))
+		case s.Policy == nil:
+			errs = append(errs, fmt.Errorf("%s, Policy required", name))
+		case len(s.Policy.Groups) > 0:
+			errs = append(errs, fmt.Errorf("%s, Groups should be omitted", name))
+		case s.Policy.Exempt:
+			errs = append(errs, fmt.Errorf("%s, Exempt should be omitted", name))
+		case len(s.Policy.Tiers) > 0:
+			errs = append(errs, fmt.Errorf("%s, Tiers should be omitted", name))
+		default:
+			p, err := s.Policy.compileAs(name, opts.Algorithm, opts)
+			if err == nil && p.Algorithm == Default {
+				err = fmt.Errorf("%s requires an algorithm other than Default", name)
+			}
+			if err == nil {
+				err = checkPolicy(name, p, opts, store)
+			}
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			s.Policy = p
+			scopes = append(scopes, s)
+		}
+		names[s.Name] = true
+	}
+	return scopes, errs
+}
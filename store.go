@@ -0,0 +1,93 @@
+package ratelimiter
+
+import (
+	"errors"
+	"time"
+)
+
+// Algorithm is a rate limiting algorithm.
+type Algorithm string
+
+// Algorithms supported by ratelimiter. Except Default, they are run by a Store and all
+// limits of a policy are checked together, so "10 per second and 100 per minute" means both.
+const (
+	// Default is the algorithm of github.com/teambition/ratelimiter-go: a fixed window
+	// starting with the first request, the limits of a policy are applied in turn
+	// when the client keeps exceeding them.
+	Default Algorithm = ""
+	// FixedWindow counts requests in a window starting with the first request.
+	FixedWindow Algorithm = "fixed-window"
+	// SlidingWindow weights the count of the previous window by its overlap with
+	// the sliding window, a cheap approximation of SlidingLog.
+	SlidingWindow Algorithm = "sliding-window"
+	// SlidingLog records every request in the window, it is exact but takes memory.
+	SlidingLog Algorithm = "sliding-log"
+	// TokenBucket refills Max tokens per Window into a bucket of Burst tokens,
+	// it allows bursts and then a steady rate.
+	TokenBucket Algorithm = "token-bucket"
+	// GCRA (generic cell rate algorithm) spaces requests evenly by Window/Max,
+	// with Burst requests of tolerance. It only keeps a timestamp per key.
+	GCRA Algorithm = "gcra"
+)
+
+var errUnknownAlgorithm = errors.New("ratelimiter: unknown algorithm")
+
+// Limit allows Max units in Window.
+type Limit struct {
+	Max    int
+	Window time.Duration
+}
+
+// Request takes Cost units from the Key in a Store.
+type Request struct {
+	Key       string
+	Algorithm Algorithm
+	Limit     Limit
+	// Burst is the bucket capacity of TokenBucket and GCRA, default is Limit.Max.
+	Burst int
+	// Cost is the units taken, a request with Cost 0 checks the key without changing it.
+	Cost int
+}
+
+// Usage is the state of a key after a Request.
+type Usage struct {
+	// Allowed is true if the cost was taken.
+	Allowed bool
+	// Total is the max count, or the bucket capacity.
+	Total int
+	// Remaining is the count still available.
+	Remaining int
+	// Reset is the time when the key will be fully available again.
+	Reset time.Time
+	// RetryAfter is the time to wait for the cost being available, zero if Allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps the state of limiting algorithms, it must be safe for concurrent use.
+// NewMemoryStore returns a Store in memory, and the clients of
+// github.com/teambition/gear-ratelimiter/redis implement it with redis scripts.
+type Store interface {
+	// Take checks the request and takes its cost if allowed.
+	Take(req Request) (Usage, error)
+}
+
+// BatchStore is a Store checking several requests atomically, the memory Store and the
+// single node redis client implement it. The requests of a client are taken by one TakeAll:
+// every limit of its policy, groups and scopes.
+type BatchStore interface {
+	Store
+	// TakeAll checks all requests and takes their costs only if all are allowed, so a rejected
+	// request consumes nothing. Usages are returned in the order of reqs, the ones of allowed
+	// requests in a rejected batch describe the state as if they were taken. Keys of reqs
+	// should be distinct.
+	TakeAll(reqs []Request) ([]Usage, error)
+}
+
+// RefundStore is a Store giving back the cost of taken requests, the memory Store and the clients
+// of github.com/teambition/gear-ratelimiter/redis implement it.
+type RefundStore interface {
+	Store
+	// Refund gives the Cost of reqs back to their keys atomically, counts don't go below zero
+	// and buckets don't go over their capacity. Keys that expired are not changed.
+	Refund(reqs []Request) error
+}
@@ -0,0 +1,272 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError reports all problems of Options found by Validate or NewE,
+// or of a policy file found by LoadPolicies.
+type ValidationError struct {
+	Errors []error
+
+	subject string // "options" if empty
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	subject := e.subject
+	if subject == "" {
+		subject = "options"
+	}
+	return "ratelimiter: invalid " + subject + ": " + strings.Join(msgs, "; ")
+}
+
+// compiled is the result of checking Options.
+type compiled struct {
+	set           *policySet
+	defaultPolicy *Policy
+	groups        map[string]*Policy // compiled policies of Options.Groups
+	scopes        []Scope            // Options.Scopes with compiled policies
+	store         Store
+}
+
+// policySet is a set of compiled policies, it is swapped by UpdatePolicies.
+type policySet struct {
+	policies map[string]*Policy // compiled policies by policy key
+	matcher  *matcher
+}
+
+// Validate checks Options and all policy keys and values, it returns a *ValidationError
+// with every problem found, or nil.
+func (opts *Options) Validate() error {
+	_, err := opts.compile()
+	return err
+}
+
+// compile checks opts and compiles the policies, it has no side effects.
+func (opts *Options) compile() (*compiled, error) {
+	var errs []error
+	report := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if opts.Max < 0 {
+		report("Max should not be negative, got %d", opts.Max)
+	}
+	if opts.Duration < 0 {
+		report("Duration should not be negative, got %s", opts.Duration)
+	}
+	if opts.Instances < 0 {
+		report("Instances should not be negative, got %d", opts.Instances)
+	}
+	if opts.ResolveTTL < 0 {
+		report("ResolveTTL should not be negative, got %s", opts.ResolveTTL)
+	}
+	if opts.ProbeInterval < 0 {
+		report("ProbeInterval should not be negative, got %s", opts.ProbeInterval)
+	}
+	if _, err := parseCIDRs(opts.TrustedProxies); err != nil {
+		report("TrustedProxies, %v", err)
+	}
+	if opts.IPv6Prefix < 0 || opts.IPv6Prefix > 128 {
+		report("IPv6Prefix should be between 0 and 128, got %d", opts.IPv6Prefix)
+	}
+	if opts.FailMode != FailOpen && opts.FailMode != FailClosed && opts.FailMode != FailLocal {
+		report("unknown FailMode %d", opts.FailMode)
+	}
+
+	policies := make(map[string]*Policy, len(opts.Policy)+len(opts.Policies))
+	for _, key := range sortedKeys(opts.Policy) {
+		if p := opts.Policy[key]; len(p)%2 != 0 {
+			report("policy %q, should be pairs of max count and milliseconds, got %v", key, p)
+			continue
+		}
+		converted, _ := ConvertPolicy(map[string][]int{key: opts.Policy[key]})
+		policies[key] = converted[key]
+	}
+	for _, key := range sortedKeys(opts.Policies) {
+		p := opts.Policies[key]
+		if _, ok := opts.Policy[key]; ok {
+			report("policy %q is in both Policy and Policies", key)
+		} else if p == nil {
+			report("policy %q is nil", key)
+		} else {
+			policies[key] = p
+		}
+	}
+	c := &compiled{}
+	if opts.Client == nil {
+		c.store = NewMemoryStore()
+	} else if store, ok := opts.Client.(Store); ok {
+		c.store = store
+	}
+	c.groups = make(map[string]*Policy, len(opts.Groups))
+	for _, name := range sortedKeys(opts.Groups) {
+		if opts.Groups[name] == nil {
+			report("group %q is nil", name)
+			continue
+		}
+		g, err := opts.Groups[name].compileGroup(name, opts)
+		if err == nil && g.Algorithm == Default {
+			err = fmt.Errorf("group %q requires an algorithm other than Default", name)
+		}
+		if err == nil {
+			err = checkPolicy(fmt.Sprintf("group %q", name), g, opts, c.store)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.groups[name] = g
+	}
+	scopes, scopeErrs := opts.compileScopes(c.store)
+	c.scopes = scopes
+	errs = append(errs, scopeErrs...)
+	set, setErrs := opts.compilePolicies(policies, c.store)
+	c.set = set
+	errs = append(errs, setErrs...)
+
+	p := &Policy{Limits: []Limit{{Max: opts.Max, Window: opts.Duration}}}
+	if p.Limits[0].Max <= 0 {
+		p.Limits[0].Max = 100
+	}
+	if p.Limits[0].Window <= 0 {
+		p.Limits[0].Window = time.Minute
+	}
+	if len(opts.DefaultPolicy) > 0 {
+		if len(opts.DefaultPolicy)%2 != 0 {
+			report("default policy, should be pairs of max count and milliseconds, got %v", opts.DefaultPolicy)
+			p = nil
+		} else {
+			converted, _ := ConvertPolicy(map[string][]int{"": opts.DefaultPolicy})
+			p = converted[""]
+		}
+	}
+	if p != nil {
+		var err error
+		if c.defaultPolicy, err = p.compile("", opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.store == nil && c.defaultPolicy != nil && c.defaultPolicy.Algorithm != Default {
+		report("default policy, Client should implement Store for algorithm %q", c.defaultPolicy.Algorithm)
+	}
+	if len(opts.Scopes) > 0 && !opts.IgnoreUnmatched && c.defaultPolicy != nil && c.defaultPolicy.Algorithm == Default {
+		report("default policy, Scopes require an algorithm other than Default")
+	}
+	if opts.Cost != nil && !opts.IgnoreUnmatched && c.defaultPolicy != nil && c.defaultPolicy.Algorithm == Default {
+		report("default policy, Cost requires an algorithm other than Default")
+	}
+
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	return c, nil
+}
+
+// compilePolicies checks and compiles policies with the defaults of opts, and checks that
+// every key of Options.Algorithms has a policy, the set is nil if there are errors.
+func (opts *Options) compilePolicies(policies map[string]*Policy, store Store) (*policySet, []error) {
+	var errs []error
+	for _, key := range sortedKeys(opts.Algorithms) {
+		if _, ok := policies[key]; !ok {
+			errs = append(errs, fmt.Errorf("Algorithms key %q matches no policy", key))
+		}
+	}
+	set := &policySet{policies: make(map[string]*Policy, len(policies))}
+	keys := sortedKeys(policies)
+	for _, key := range keys {
+		if _, err := compileRoute(key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if policies[key] == nil {
+			errs = append(errs, fmt.Errorf("policy %q is nil", key))
+			continue
+		}
+		p, err := policies[key].compile(key, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err = checkPolicy(fmt.Sprintf("policy %q", key), p, opts, store); err != nil {
+			errs = append(errs, err)
+		}
+		set.policies[key] = p
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	set.matcher, _ = newMatcher(keys)
+	return set, nil
+}
+
+// checkPolicy checks a compiled policy against opts and store.
+func checkPolicy(name string, p *Policy, opts *Options, store Store) error {
+	if len(p.Tiers) > 0 && opts.GetTier == nil && opts.DefaultTier == "" {
+		return fmt.Errorf("%s has Tiers, GetTier or DefaultTier required", name)
+	}
+	if store == nil && p.Algorithm != Default {
+		return fmt.Errorf("%s, Client should implement Store for algorithm %q", name, p.Algorithm)
+	}
+	if _, ok := store.(RefundStore); p.RefundIf != nil && !ok {
+		return fmt.Errorf("%s, Client should implement RefundStore for RefundIf", name)
+	}
+	for _, group := range p.Groups {
+		if opts.Groups[group] == nil {
+			return fmt.Errorf("%s, unknown group %q", name, group)
+		}
+	}
+	// Default algorithm counts when it checks, so it can't be taken together with other checks,
+	// and a request rejected by a group or scope would consume the quota of the policy.
+	if p.Algorithm == Default && len(p.Groups) > 0 {
+		return fmt.Errorf("%s, Groups require an algorithm other than Default", name)
+	}
+	if p.Algorithm == Default && len(opts.Scopes) > 0 {
+		return fmt.Errorf("%s, Scopes require an algorithm other than Default", name)
+	}
+	if p.Algorithm == Default && opts.Cost != nil && !p.Exempt {
+		return fmt.Errorf("%s, Cost requires an algorithm other than Default", name)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map with string keys in order, so that errors are stable.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string][]int:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*Policy:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]Algorithm:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string][]Limit:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*ConcurrencyPolicy:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*AdaptivePolicy:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}